@@ -0,0 +1,251 @@
+package circularbuffer
+
+import (
+	"context"
+	"math"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AccessList matches keys by exact key, by key prefix and, if the
+// key is an IP address, by CIDR. An AccessList is immutable, such that
+// it can be shared and matched without locks. A nil *AccessList
+// matches nothing.
+type AccessList struct {
+	exact    map[string]struct{}
+	prefixes *prefixTree
+	ipv4     *bitTree
+	ipv6     *bitTree
+}
+
+// NewAccessList returns an AccessList of the given entries. An entry
+// ending with "*" matches all keys with the given prefix, an entry in
+// CIDR notation, for example "10.0.0.0/8" or "2001:db8::/32", matches
+// all keys that are an IP address, optionally with port, within the
+// network. All other entries match the exact key.
+func NewAccessList(entries ...string) (*AccessList, error) {
+	al := &AccessList{
+		exact:    make(map[string]struct{}),
+		prefixes: &prefixTree{},
+		ipv4:     &bitTree{},
+		ipv6:     &bitTree{},
+	}
+	for _, e := range entries {
+		switch {
+		case e == "":
+			return nil, &ArgumentError{Name: "entry", Value: e}
+		case strings.HasSuffix(e, "*"):
+			al.prefixes.insert(strings.TrimSuffix(e, "*"))
+		case strings.Contains(e, "/"):
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				return nil, &ArgumentError{Name: "entry", Value: e}
+			}
+			p = p.Masked()
+			if p.Addr().Is4() {
+				al.ipv4.insert(p.Addr().AsSlice(), p.Bits())
+			} else {
+				al.ipv6.insert(p.Addr().AsSlice(), p.Bits())
+			}
+		default:
+			al.exact[e] = struct{}{}
+		}
+	}
+	return al, nil
+}
+
+// Match returns true if the key s matches an entry of the list.
+func (al *AccessList) Match(s string) bool {
+	if al == nil {
+		return false
+	}
+	if _, ok := al.exact[s]; ok {
+		return true
+	}
+	if al.prefixes.match(s) {
+		return true
+	}
+	addr, ok := parseAddr(s)
+	if !ok {
+		return false
+	}
+	if addr.Is4() {
+		b := addr.As4()
+		return al.ipv4.match(b[:])
+	}
+	b := addr.As16()
+	return al.ipv6.match(b[:])
+}
+
+// parseAddr parses s as IP address or IP address and port. IPv4
+// mapped IPv6 addresses are matched as IPv4 addresses.
+func parseAddr(s string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// prefixTree is a byte wise prefix tree of key prefixes.
+type prefixTree struct {
+	children map[byte]*prefixTree
+	terminal bool
+}
+
+func (t *prefixTree) insert(prefix string) {
+	for i := 0; i < len(prefix); i++ {
+		if t.children == nil {
+			t.children = make(map[byte]*prefixTree)
+		}
+		child, ok := t.children[prefix[i]]
+		if !ok {
+			child = &prefixTree{}
+			t.children[prefix[i]] = child
+		}
+		t = child
+	}
+	t.terminal = true
+}
+
+func (t *prefixTree) match(s string) bool {
+	for i := 0; ; i++ {
+		if t.terminal {
+			return true
+		}
+		if i == len(s) {
+			return false
+		}
+		if t = t.children[s[i]]; t == nil {
+			return false
+		}
+	}
+}
+
+// bitTree is a binary radix tree of network prefixes.
+type bitTree struct {
+	children [2]*bitTree
+	terminal bool
+}
+
+func (t *bitTree) insert(addr []byte, bits int) {
+	for i := 0; i < bits; i++ {
+		b := addr[i/8] >> (7 - i%8) & 1
+		if t.children[b] == nil {
+			t.children[b] = &bitTree{}
+		}
+		t = t.children[b]
+	}
+	t.terminal = true
+}
+
+func (t *bitTree) match(addr []byte) bool {
+	for i := 0; ; i++ {
+		if t.terminal {
+			return true
+		}
+		if i == len(addr)*8 {
+			return false
+		}
+		b := addr[i/8] >> (7 - i%8) & 1
+		if t = t.children[b]; t == nil {
+			return false
+		}
+	}
+}
+
+// ListLimiter wraps a RateLimiter with an allow list and a deny list.
+// Keys matching the deny list are always rate limited, keys matching
+// the allow list are never rate limited and not counted by the
+// wrapped RateLimiter. The deny list has precedence. Both lists can
+// be replaced at runtime, Allow does not take any lock.
+type ListLimiter struct {
+	limiter RateLimiter
+	allow   atomic.Pointer[AccessList]
+	deny    atomic.Pointer[AccessList]
+}
+
+// NewListLimiter returns a ListLimiter wrapping rl with the given
+// allow and deny list, both may be nil.
+func NewListLimiter(rl RateLimiter, allow, deny *AccessList) *ListLimiter {
+	l := &ListLimiter{limiter: rl}
+	l.allow.Store(allow)
+	l.deny.Store(deny)
+	return l
+}
+
+// SetAllowList replaces the allow list.
+func (l *ListLimiter) SetAllowList(al *AccessList) {
+	l.allow.Store(al)
+}
+
+// SetDenyList replaces the deny list.
+func (l *ListLimiter) SetDenyList(al *AccessList) {
+	l.deny.Store(al)
+}
+
+// Allow returns false for denied keys, true for allowed keys and the
+// decision of the wrapped RateLimiter for all other keys.
+func (l *ListLimiter) Allow(ctx context.Context, s string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	s = keyOf(ctx, s)
+	var allowed bool
+	switch {
+	case l.deny.Load().Match(s):
+	case l.allow.Load().Match(s):
+		allowed = true
+	default:
+		allowed = l.limiter.Allow(ctx, s)
+	}
+	recordDecision(ctx, l, s, allowed)
+	return allowed
+}
+
+// Close closes the wrapped RateLimiter.
+func (l *ListLimiter) Close() {
+	l.limiter.Close()
+}
+
+// Oldest implements the RateLimiter interface
+func (l *ListLimiter) Oldest(s string) time.Time {
+	return l.limiter.Oldest(s)
+}
+
+// Delta implements the RateLimiter interface
+func (l *ListLimiter) Delta(s string) time.Duration {
+	return l.limiter.Delta(s)
+}
+
+// Resize implements the RateLimiter interface
+func (l *ListLimiter) Resize(s string, n int) error {
+	return l.limiter.Resize(s, n)
+}
+
+// Remaining returns 0 for denied keys, math.MaxInt for allowed keys
+// and the remaining requests of the wrapped RateLimiter for all other
+// keys.
+func (l *ListLimiter) Remaining(s string) int {
+	if l.deny.Load().Match(s) {
+		return 0
+	}
+	if l.allow.Load().Match(s) {
+		return math.MaxInt
+	}
+	return l.limiter.Remaining(s)
+}
+
+// Reset implements the RateLimiter interface
+func (l *ListLimiter) Reset(s string) {
+	l.limiter.Reset(s)
+}
+
+// RetryAfter implements the RateLimiter interface
+func (l *ListLimiter) RetryAfter(s string) int {
+	return l.limiter.RetryAfter(s)
+}
@@ -0,0 +1,121 @@
+package circularbuffer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccessListMatch(t *testing.T) {
+	al, err := NewAccessList(
+		"healthcheck",
+		"internal-*",
+		"10.0.0.0/8",
+		"192.168.1.1/32",
+		"2001:db8::/32",
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tt := range []struct {
+		key  string
+		want bool
+	}{
+		{"healthcheck", true},
+		{"healthcheck2", false},
+		{"health", false},
+		{"internal-", true},
+		{"internal-batch", true},
+		{"internal", false},
+		{"10.1.2.3", true},
+		{"10.1.2.3:8080", true},
+		{"::ffff:10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"2001:db8::1", true},
+		{"[2001:db8::1]:443", true},
+		{"2001:db9::1", false},
+		{"", false},
+	} {
+		if got := al.Match(tt.key); got != tt.want {
+			t.Errorf("Match(%q): expected %v, got %v", tt.key, tt.want, got)
+		}
+	}
+
+	var nilList *AccessList
+	if nilList.Match("healthcheck") {
+		t.Errorf("nil list should match nothing")
+	}
+}
+
+func TestAccessListInvalidEntries(t *testing.T) {
+	for _, e := range []string{"", "10.0.0.0/33", "foo/bar"} {
+		if _, err := NewAccessList(e); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%q: expected ErrInvalidArgument, got %v", e, err)
+		}
+	}
+}
+
+func TestListLimiter(t *testing.T) {
+	allow, _ := NewAccessList("10.0.0.0/8")
+	deny, _ := NewAccessList("10.6.6.6", "evil-*")
+	l := NewListLimiter(newClientRateLimiter(1, time.Minute), allow, deny)
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow(t.Context(), "10.1.1.1") {
+			t.Errorf("allowed key should never be rate limitted")
+		}
+		if l.Allow(t.Context(), "10.6.6.6") {
+			t.Errorf("denied key should always be rate limitted")
+		}
+		if l.Allow(t.Context(), "evil-bot") {
+			t.Errorf("denied prefix should always be rate limitted")
+		}
+	}
+	if !l.Allow(t.Context(), "foo") || l.Allow(t.Context(), "foo") {
+		t.Errorf("other keys should be rate limitted by the wrapped limiter")
+	}
+	if l.Remaining("10.6.6.6") != 0 {
+		t.Errorf("denied key should have no remaining requests")
+	}
+	if l.Remaining("10.1.1.1") <= 1 {
+		t.Errorf("allowed key should have unlimited remaining requests")
+	}
+
+	l.SetDenyList(nil)
+	if !l.Allow(t.Context(), "evil-bot") {
+		t.Errorf("evil-bot should not be rate limitted after removing the deny list")
+	}
+}
+
+func TestListLimiterConcurrentUpdate(t *testing.T) {
+	l := NewListLimiter(newClientRateLimiter(1<<10, time.Minute), nil, nil)
+	defer l.Close()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1<<10; i++ {
+			l.Allow(t.Context(), "10.0.0.1")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1<<6; i++ {
+			al, _ := NewAccessList("10.0.0.0/8")
+			l.SetAllowList(al)
+			l.SetAllowList(nil)
+		}
+	}()
+	wg.Wait()
+}
+
+func BenchmarkAccessListMatch(b *testing.B) {
+	al, _ := NewAccessList("internal-*", "10.0.0.0/8", "2001:db8::/32")
+	for n := 0; n < b.N; n++ {
+		al.Match("2001:db8::1")
+	}
+}
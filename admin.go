@@ -0,0 +1,148 @@
+package circularbuffer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultAdminPageSize = 100
+	maxAdminPageSize     = 1000
+)
+
+// AdminKey is the state of a key returned by the admin API.
+type AdminKey struct {
+	Key string `json:"key"`
+	KeyInfo
+}
+
+// AdminKeyList is a page of keys returned by the admin API.
+type AdminKeyList struct {
+	// Total is the number of active keys.
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Keys   []AdminKey `json:"keys"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+type adminResize struct {
+	Size int `json:"size"`
+}
+
+// NewAdminHandler returns an http.Handler to inspect and tune the keys
+// of rl. All responses are JSON. It serves the following routes,
+// relative to the root of the handler, use http.StripPrefix to mount it
+// on a sub path:
+//
+//	GET    /keys?offset=0&limit=100  list keys sorted by usage, most used first
+//	GET    /keys/{key}               show the state of a key
+//	POST   /keys/{key}/reset         remove all requests of a key
+//	POST   /keys/{key}/resize        resize a key, body {"size": 20}
+//	DELETE /keys/{key}               remove the state of a key
+//
+// The handler does not do any authorization, it must only be exposed
+// to operators.
+func NewAdminHandler(rl *ClientRateLimiter) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		offset, err := queryInt(r, "offset", 0)
+		if err != nil || offset < 0 {
+			writeAdminError(w, http.StatusBadRequest, &ArgumentError{Name: "offset", Value: r.URL.Query().Get("offset")})
+			return
+		}
+		limit, err := queryInt(r, "limit", defaultAdminPageSize)
+		if err != nil || limit <= 0 || limit > maxAdminPageSize {
+			writeAdminError(w, http.StatusBadRequest, &ArgumentError{Name: "limit", Value: r.URL.Query().Get("limit")})
+			return
+		}
+
+		var keys []AdminKey
+		rl.Range(func(k string, info KeyInfo) bool {
+			keys = append(keys, AdminKey{Key: k, KeyInfo: info})
+			return true
+		})
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].Len != keys[j].Len {
+				return keys[i].Len > keys[j].Len
+			}
+			return keys[i].Key < keys[j].Key
+		})
+
+		list := AdminKeyList{Total: len(keys), Offset: offset, Keys: []AdminKey{}}
+		if offset < len(keys) {
+			list.Keys = keys[offset:min(offset+limit, len(keys))]
+		}
+		writeAdminJSON(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("GET /keys/{key}", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminKey(w, rl, r.PathValue("key"))
+	})
+	mux.HandleFunc("POST /keys/{key}/reset", func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if err := rl.reset(key); err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		writeAdminKey(w, rl, key)
+	})
+	mux.HandleFunc("POST /keys/{key}/resize", func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		var body adminResize
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := rl.Resize(key, body.Size); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrKeyNotFound) {
+				status = http.StatusNotFound
+			}
+			writeAdminError(w, status, err)
+			return
+		}
+		writeAdminKey(w, rl, key)
+	})
+	mux.HandleFunc("DELETE /keys/{key}", func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		info, ok := rl.info(key)
+		if !ok || !rl.Remove(key) {
+			writeAdminError(w, http.StatusNotFound, keyNotFound(key))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, AdminKey{Key: key, KeyInfo: info})
+	})
+	return mux
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func writeAdminKey(w http.ResponseWriter, rl *ClientRateLimiter, key string) {
+	info, ok := rl.info(key)
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, keyNotFound(key))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, AdminKey{Key: key, KeyInfo: info})
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, adminError{Error: err.Error()})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
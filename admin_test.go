@@ -0,0 +1,109 @@
+package circularbuffer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAdminTest(t *testing.T) (*ClientRateLimiter, *fakeClock, http.Handler) {
+	t.Helper()
+	clock := newFakeClock()
+	rl, err := NewClientRateLimiterWithOptions(5, time.Minute, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rl.Close)
+	for k, n := range map[string]int{"a": 1, "b": 3, "c": 2, "d": 3} {
+		for i := 0; i < n; i++ {
+			rl.Allow(context.Background(), k)
+		}
+	}
+	return rl, clock, NewAdminHandler(rl)
+}
+
+func serveAdmin(t *testing.T, h http.Handler, method, target, body string, wantStatus int, v interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if rec.Code != wantStatus {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, target, rec.Code, wantStatus, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s %s: Content-Type %q", method, target, ct)
+	}
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+}
+
+func TestAdminHandlerList(t *testing.T) {
+	_, _, h := newAdminTest(t)
+
+	var list AdminKeyList
+	serveAdmin(t, h, "GET", "/keys", "", http.StatusOK, &list)
+	var keys []string
+	for _, k := range list.Keys {
+		keys = append(keys, k.Key)
+	}
+	if got := strings.Join(keys, ","); got != "b,d,c,a" || list.Total != 4 {
+		t.Errorf("Keys %s, total %d, want b,d,c,a, total 4", got, list.Total)
+	}
+	if list.Keys[0].Len != 3 || list.Keys[0].Cap != 5 || list.Keys[0].Remaining != 2 {
+		t.Errorf("Unexpected key info %+v", list.Keys[0])
+	}
+
+	serveAdmin(t, h, "GET", "/keys?offset=1&limit=2", "", http.StatusOK, &list)
+	if len(list.Keys) != 2 || list.Keys[0].Key != "d" || list.Keys[1].Key != "c" || list.Offset != 1 {
+		t.Errorf("Unexpected page %+v", list)
+	}
+	serveAdmin(t, h, "GET", "/keys?offset=10", "", http.StatusOK, &list)
+	if len(list.Keys) != 0 || list.Total != 4 {
+		t.Errorf("Unexpected page %+v", list)
+	}
+	serveAdmin(t, h, "GET", "/keys?limit=0", "", http.StatusBadRequest, nil)
+	serveAdmin(t, h, "GET", "/keys?offset=x", "", http.StatusBadRequest, nil)
+}
+
+func TestAdminHandlerKey(t *testing.T) {
+	rl, clock, h := newAdminTest(t)
+	for i := 0; i < 2; i++ {
+		rl.Allow(context.Background(), "b")
+	}
+	clock.Advance(time.Second)
+
+	var k AdminKey
+	serveAdmin(t, h, "GET", "/keys/b", "", http.StatusOK, &k)
+	if k.Key != "b" || k.Len != 5 || k.RetryAfter != 59 || k.Remaining != 0 || k.Oldest.IsZero() {
+		t.Errorf("Unexpected key %+v", k)
+	}
+	serveAdmin(t, h, "GET", "/keys/x", "", http.StatusNotFound, nil)
+
+	serveAdmin(t, h, "POST", "/keys/b/reset", "", http.StatusOK, &k)
+	if k.Len != 0 || k.Cap != 5 || !rl.Allow(context.Background(), "b") {
+		t.Errorf("Key should be reset: %+v", k)
+	}
+
+	serveAdmin(t, h, "POST", "/keys/b/resize", `{"size": 10}`, http.StatusOK, &k)
+	if k.Cap != 10 || k.Len != 1 {
+		t.Errorf("Key should be resized: %+v", k)
+	}
+	serveAdmin(t, h, "POST", "/keys/b/resize", `{"size": 0}`, http.StatusBadRequest, nil)
+	serveAdmin(t, h, "POST", "/keys/x/resize", `{"size": 1}`, http.StatusNotFound, nil)
+	serveAdmin(t, h, "POST", "/keys/b/resize", `size`, http.StatusBadRequest, nil)
+
+	serveAdmin(t, h, "DELETE", "/keys/b", "", http.StatusOK, &k)
+	if k.Key != "b" || k.Cap != 10 {
+		t.Errorf("Unexpected deleted key %+v", k)
+	}
+	if rl.Remaining("b") != 5 {
+		t.Error("Key should be deleted")
+	}
+	serveAdmin(t, h, "DELETE", "/keys/b", "", http.StatusNotFound, nil)
+}
@@ -1,61 +1,163 @@
 package circularbuffer
 
 import (
-	"fmt"
+	"context"
+	"math"
+	"runtime"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// CircularBuffer has slots to store times as int64 and an offset,
-// which marks the next free entry. Slots are fixed in size.
+// epoch is the reference time of the monotonic nanoseconds stored in
+// the slots of a CircularBuffer.
+var epoch = time.Now()
+
+// empty marks a slot that was never written. It is older than every
+// other value, such that an empty slot is always free.
+const empty int64 = math.MinInt64
+
+// frozen marks a slot of a retired ring, see CircularBuffer.resize.
+const frozen int64 = math.MaxInt64
+
+func toNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return empty
+	}
+	return int64(t.Sub(epoch))
+}
+
+func fromNanos(n int64) time.Time {
+	if n == empty {
+		return time.Time{}
+	}
+	return epoch.Add(time.Duration(n))
+}
+
+// ring is the storage of a CircularBuffer. offset is a ticket counter,
+// which is advanced by CAS, offset % len(slots) is the next slot to be
+// written. A negative offset marks a retired ring, that was replaced
+// by resize.
+type ring struct {
+	slots  []atomic.Int64
+	offset atomic.Int64
+}
+
+func newRing(l int) *ring {
+	r := &ring{slots: make([]atomic.Int64, l)}
+	for i := range r.slots {
+		r.slots[i].Store(empty)
+	}
+	return r
+}
+
+// CircularBuffer has slots to store times as int64 monotonic
+// nanoseconds and an offset, which marks the next free entry. Slots
+// are fixed in size. All operations, but resize and the writers of a
+// buffer with a burst, are lock-free.
 type CircularBuffer struct {
-	sync.RWMutex
-	slots      []time.Time
-	offset     int
-	timeWindow time.Duration
+	mu     sync.Mutex // serializes resize
+	ring   atomic.Pointer[ring]
+	window atomic.Int64
+	burst  int
+	clock  Clock
+	hooks  Hooks
+	// smoothing, see WithMinInterval and WithMaxDelay
+	smoothed    bool
+	minInterval time.Duration
+	maxDelay    time.Duration
 }
 
 func NewCircularBuffer(l int, t time.Duration) *CircularBuffer {
-	return &CircularBuffer{
-		slots:      make([]time.Time, l),
-		offset:     0,
-		timeWindow: t,
+	return defaultConfig(l, t).newCircularBuffer()
+}
+
+// NewCircularBufferWithOptions returns a new CircularBuffer with l
+// slots and time window t configured by opts. It returns an
+// *ArgumentError if l, t or an option are invalid.
+func NewCircularBufferWithOptions(l int, t time.Duration, opts ...Option) (*CircularBuffer, error) {
+	c, err := newConfig(l, t, opts)
+	if err != nil {
+		return nil, err
 	}
+	return c.newCircularBuffer(), nil
 }
 
-func (cb *CircularBuffer) Cap() int {
-	return len(cb.slots)
+func (c *config) newCircularBuffer() *CircularBuffer {
+	cb := &CircularBuffer{
+		burst:       c.burst,
+		clock:       c.clock,
+		hooks:       c.hooks,
+		smoothed:    c.algorithm == Smoothed,
+		minInterval: c.minInterval,
+		maxDelay:    c.maxDelay,
+	}
+	cb.window.Store(int64(c.timeWindow))
+	cb.ring.Store(newRing(c.maxHits + c.burst))
+	return cb
 }
 
-func (cb *CircularBuffer) Len() int {
-	n := 0
-	for i := 0; i < len(cb.slots); i++ {
-		cb.RLock()
-		slot := cb.slots[i]
-		cb.RUnlock()
-		if slot.Add(cb.timeWindow).After(time.Now()) {
-			n++
+// timeWindow returns the time window of the slots of the buffer,
+// which is the interval of the sustained rate, if the buffer has a
+// burst, see WithBurst.
+func (cb *CircularBuffer) timeWindow() time.Duration {
+	return slotWindow(cb.Cap()-cb.burst, cb.burst, cb.sustainedWindow())
+}
+
+// sustainedWindow returns the time window of the sustained rate.
+func (cb *CircularBuffer) sustainedWindow() time.Duration {
+	return time.Duration(cb.window.Load())
+}
+
+// load returns the current ring and offset. The offset is always >= 0.
+func (cb *CircularBuffer) load() (*ring, int64) {
+	for {
+		r := cb.ring.Load()
+		if off := r.offset.Load(); off >= 0 {
+			return r, off
 		}
+		// resize in progress
+		runtime.Gosched()
 	}
-	return n
 }
 
-func (cb *CircularBuffer) InUse() bool {
-	cb.RLock()
-	l := len(cb.slots)
-	offset := cb.offset
-	cb.RUnlock()
-
-	newestOffset := (offset - 1) % l
-	if newestOffset < 0 {
-		newestOffset = l + newestOffset
+// read calls f with a consistent view of the ring, such that f never
+// observes a slot frozen by a concurrent resize.
+func (cb *CircularBuffer) read(f func(r *ring, off int64)) {
+	for {
+		r, off := cb.load()
+		f(r, off)
+		if r.offset.Load() >= 0 {
+			return
+		}
 	}
+}
 
-	cb.RLock()
-	slot := cb.slots[newestOffset]
-	cb.RUnlock()
+func (cb *CircularBuffer) Cap() int {
+	return len(cb.ring.Load().slots)
+}
 
-	return slot.Add(cb.timeWindow).After(time.Now())
+// Len returns the number of slots used in the current time window.
+// Slots are written in time order starting at the offset, which is
+// the oldest entry, so Len does a binary search for the oldest entry
+// within the time window in O(log n).
+func (cb *CircularBuffer) Len() int {
+	var n int
+	cb.read(func(r *ring, off int64) {
+		l := int64(len(r.slots))
+		since := toNanos(cb.clock.Now()) - int64(cb.timeWindow())
+		i := sort.Search(int(l), func(i int) bool {
+			return r.slots[(off+int64(i))%l].Load() > since
+		})
+		n = int(l) - i
+	})
+	return n
+}
+
+func (cb *CircularBuffer) InUse() bool {
+	return cb.current().Add(cb.timeWindow()).After(cb.clock.Now())
 }
 
 // Free returns if there is space or the bucket is full for the current time.
@@ -67,14 +169,17 @@ func (cb *CircularBuffer) InUse() bool {
 //	       ^
 //	5-2 = 3 --> 2 free slots [1,2] are too old and are Free already
 func (cb *CircularBuffer) Free() bool {
-	cb.RLock()
-	slot := cb.slots[cb.offset]
-	cb.RUnlock()
-	return slot.Add(cb.timeWindow).Before(time.Now())
+	return cb.free(cb.Next(), cb.clock.Now())
+}
+
+func (cb *CircularBuffer) free(slot, now time.Time) bool {
+	return slot.Add(cb.timeWindow()).Before(now)
 }
 
 // Add adds an element to the next free bucket in the buffer and
-// returns true. It returns false if there is no free bucket.
+// returns true. It returns false if there is no free bucket at time t.
+// The zero time.Time marks empty buckets, so Add(time.Time{}) always
+// returns false, before v0.3 it was added like any other time.
 // Example
 //
 //	[_ _ _ _]
@@ -87,80 +192,403 @@ func (cb *CircularBuffer) Free() bool {
 //	       ^
 //	[1 2 3 4]
 //	 ^
+//
+// Add claims the slot by advancing the offset with a CAS and writes
+// the slot with a CAS from the value it checked to be free. Each free
+// value can only be replaced once, so concurrent callers can never
+// exceed the capacity of the buffer. With a burst, see WithBurst, Add
+// is serialized with the other writers instead.
 func (cb *CircularBuffer) Add(t time.Time) bool {
-	if cb.Free() {
-		cb.Lock()
-		cb.slots[cb.offset] = t
-		cb.offset = (cb.offset + 1) % len(cb.slots)
-		cb.Unlock()
-		return true
+	if cb.burst > 0 {
+		cb.mu.Lock()
+		defer cb.mu.Unlock()
+		return cb.addBurstLocked(t, 1)
+	}
+	ts := toNanos(t)
+	if ts == empty {
+		return false
+	}
+	limit := ts - int64(cb.timeWindow())
+	for {
+		r, off := cb.load()
+		slot := &r.slots[off%int64(len(r.slots))]
+		old := slot.Load()
+		if old == frozen {
+			continue
+		}
+		if old >= limit {
+			if r.offset.Load() == off {
+				return false
+			}
+			// a concurrent Add claimed and wrote the slot after
+			// we loaded the offset, retry at the new offset
+			continue
+		}
+		if !r.offset.CompareAndSwap(off, off+1) {
+			continue
+		}
+		if slot.CompareAndSwap(old, ts) {
+			return true
+		}
+		// the ring wrapped around or was retired by resize, while we
+		// claimed the slot, retry at the new offset
 	}
-	return false
 }
 
-func (cb *CircularBuffer) current() time.Time {
-	cb.RLock()
-	curOff := cb.offset - 1
-	if curOff < 0 {
-		curOff += len(cb.slots)
+// fits returns true, if n elements can be added at time t, by the
+// same check as Add, addN and addBurstLocked.
+func (cb *CircularBuffer) fits(t time.Time, n int) bool {
+	ts := toNanos(t)
+	if ts == empty {
+		return false
 	}
-	cur := cb.slots[curOff]
-	cb.RUnlock()
-	return cur
+	limit := ts - int64(cb.timeWindow())
+	if cb.burst > 0 {
+		// addBurstLocked allows slots of exactly one slot window ago
+		limit++
+	}
+	ok := true
+	cb.read(func(r *ring, off int64) {
+		l := int64(len(r.slots))
+		if int64(n) > l {
+			ok = false
+			return
+		}
+		for i := range int64(n) {
+			if r.slots[(off+i)%l].Load() >= limit {
+				ok = false
+				return
+			}
+		}
+	})
+	return ok
 }
 
-func (cb *CircularBuffer) delta() time.Duration {
-	cb.RLock()
-	cur := cb.current()
-	next := cb.Next()
-	cb.RUnlock()
-	return cur.Sub(next)
+// addN adds n elements at time t, if n slots are free at time t, and
+// returns true. Otherwise no element is added. It is serialized with
+// resize, such that the elements are added to the same ring, and
+// lock-free with respect to Add.
+func (cb *CircularBuffer) addN(t time.Time, n int) bool {
+	if n == 1 {
+		return cb.Add(t)
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.addNLocked(t, n)
 }
 
-func (cb *CircularBuffer) Next() time.Time {
-	cb.RLock()
-	next := cb.slots[cb.offset]
-	cb.RUnlock()
-	return next
+// addNLocked is addN with cb.mu held.
+func (cb *CircularBuffer) addNLocked(t time.Time, n int) bool {
+	if cb.burst > 0 {
+		return cb.addBurstLocked(t, n)
+	}
+	if n == 1 {
+		return cb.Add(t)
+	}
+	ts := toNanos(t)
+	if ts == empty {
+		return false
+	}
+	limit := ts - int64(cb.timeWindow())
+	r := cb.ring.Load()
+	l := int64(len(r.slots))
+	if int64(n) > l {
+		return false
+	}
+	olds := make([]int64, n)
+	for {
+		off := r.offset.Load()
+		for i := range olds {
+			olds[i] = r.slots[(off+int64(i))%l].Load()
+			if olds[i] >= limit && r.offset.Load() == off {
+				return false
+			}
+		}
+		if !r.offset.CompareAndSwap(off, off+int64(n)) {
+			continue
+		}
+		for i, old := range olds {
+			// fails only if a concurrent Add wrapped around the
+			// ring and wrote a newer time into the slot
+			r.slots[(off+int64(i))%l].CompareAndSwap(old, ts)
+		}
+		return true
+	}
 }
 
-func (cb *CircularBuffer) retryAfter() time.Duration {
-	if cb.Free() {
-		return 0
+// addBurstLocked adds n elements at time t to a buffer with a burst,
+// if n slots are free at time t, and returns true. The elements are
+// scheduled one slot window after the newest element, but not before
+// t, such that a slot becomes free at the sustained rate, once the
+// burst is used up. cb.mu has to be held, such that the newest element
+// is not written concurrently.
+func (cb *CircularBuffer) addBurstLocked(t time.Time, n int) bool {
+	ts := toNanos(t)
+	if ts == empty {
+		return false
+	}
+	gap := int64(cb.timeWindow())
+	r := cb.ring.Load()
+	l := int64(len(r.slots))
+	if int64(n) > l {
+		return false
 	}
-	first := cb.Next()
-	next := first.Add(cb.timeWindow)
-	now := time.Now()
-	return next.Sub(now)
+	off := r.offset.Load()
+	for i := range int64(n) {
+		if r.slots[(off+i)%l].Load() > ts-gap {
+			return false
+		}
+	}
+	at := ts
+	if cur := r.slots[(off-1+l)%l].Load(); cur != empty && cur+gap > at {
+		at = cur + gap
+	}
+	for i := range int64(n) {
+		r.slots[(off+i)%l].Store(at + i*gap)
+	}
+	r.offset.Store(off + int64(n))
+	return true
 }
 
-// needs to be called with Lock() held by caller
-func (cb *CircularBuffer) resize(n int) {
+// charge adds n elements at time t, even if the buffer is full. An
+// element, that does not fit into the time window, is added at the
+// time the oldest element leaves the window, such that the buffer
+// stays in time order and the debt delays the following requests.
+// Only the last Cap elements stay in the buffer, each of them is
+// shifted by a window per earlier element charged on the same slot.
+// With a burst, the elements are scheduled after the newest element
+// instead, see addBurstLocked.
+func (cb *CircularBuffer) charge(t time.Time, n int) {
 	if n <= 0 {
-		fmt.Printf("resize(): refusing to resize circular buffer to %d", n)
 		return
 	}
-	cur := len(cb.slots)
-	if cur == n {
+	ts := toNanos(t)
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	window := int64(cb.timeWindow())
+	r := cb.ring.Load()
+	l := int64(len(r.slots))
+	off := r.offset.Load()
+	if cb.burst > 0 {
+		// the elements are scheduled after the newest one like
+		// by addBurstLocked
+		at := ts
+		if cur := r.slots[(off-1+l)%l].Load(); cur != empty && cur+window > at {
+			at = cur + window
+		}
+		for i := max(0, int64(n)-l); i < int64(n); i++ {
+			r.slots[(off+i)%l].Store(at + i*window)
+		}
+		r.offset.Store(off + int64(n))
 		return
 	}
-	newSlots := make([]time.Time, n)
-	if cur < n {
-		copy(newSlots, cb.slots)
-		cb.slots = newSlots
-	} else {
-		last := (cb.offset - 1) % cur
-		if last < 0 {
-			last = last + cur
+	for !r.offset.CompareAndSwap(off, off+int64(n)) {
+		off = r.offset.Load()
+	}
+	for i := range min(int64(n), l) {
+		slot := &r.slots[(off+i)%l]
+		old := slot.Load()
+		at := ts
+		if old != empty && old+window > at {
+			at = old + window
 		}
-		first := (last - (n - 1)) % cur
-		if first < 0 {
-			first = first + cur
+		at += (int64(n) - 1 - i) / l * window
+		// fails only if a concurrent Add wrapped around the ring and
+		// wrote a newer time into the slot
+		slot.CompareAndSwap(old, at)
+	}
+}
+
+// interval returns the minimum interval between two requests, see
+// WithMinInterval.
+func (cb *CircularBuffer) interval() time.Duration {
+	if cb.minInterval > 0 || !cb.smoothed {
+		return cb.minInterval
+	}
+	return cb.sustainedWindow() / time.Duration(cb.Cap()-cb.burst)
+}
+
+// take adds n elements at the current time and returns true, if they
+// are allowed. If the buffer has a minimum interval, the elements are
+// added at the interval after the newest element and take waits until
+// that time, if it is within the maximum delay. The delay is waited
+// for in wall time, also if the buffer has another Clock. Elements
+// added for a request, that is canceled by ctx while waiting, are not
+// removed.
+func (cb *CircularBuffer) take(ctx context.Context, n int) bool {
+	now := cb.clock.Now()
+	gap := cb.interval()
+	if gap <= 0 {
+		return cb.addN(now, n)
+	}
+	at, ok := cb.addSpaced(now, n, gap)
+	if !ok {
+		return false
+	}
+	d := at.Sub(now)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// addSpaced adds n elements at now, but not earlier than gap after the
+// newest element, and returns the time of the added elements.
+func (cb *CircularBuffer) addSpaced(now time.Time, n int, gap time.Duration) (time.Time, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	at := now
+	if cur := cb.current(); !cur.IsZero() && cur.Add(gap).After(at) {
+		at = cur.Add(gap)
+	}
+	if at.Sub(now) > cb.maxDelay {
+		return time.Time{}, false
+	}
+	return at, cb.addNLocked(at, n)
+}
+
+func (cb *CircularBuffer) current() time.Time {
+	var cur int64
+	cb.read(func(r *ring, off int64) {
+		l := int64(len(r.slots))
+		cur = r.slots[(off-1+l)%l].Load()
+	})
+	return fromNanos(cur)
+}
+
+func (cb *CircularBuffer) delta() time.Duration {
+	var cur, next int64
+	cb.read(func(r *ring, off int64) {
+		l := int64(len(r.slots))
+		cur = r.slots[(off-1+l)%l].Load()
+		next = r.slots[off%l].Load()
+	})
+	return fromNanos(cur).Sub(fromNanos(next))
+}
+
+func (cb *CircularBuffer) Next() time.Time {
+	var next int64
+	cb.read(func(r *ring, off int64) {
+		next = r.slots[off%int64(len(r.slots))].Load()
+	})
+	return fromNanos(next)
+}
+
+func (cb *CircularBuffer) retryAfter() time.Duration {
+	now := cb.clock.Now()
+	var d time.Duration
+	if first := cb.Next(); !cb.free(first, now) {
+		d = first.Add(cb.timeWindow()).Sub(now)
+	}
+	if gap := cb.interval(); gap > 0 {
+		if cur := cb.current(); !cur.IsZero() {
+			d = max(d, cur.Add(gap-cb.maxDelay).Sub(now))
 		}
-		for i := 0; i < n; i++ {
-			newSlots[i] = cb.slots[(first+i)%cur]
+	}
+	return d
+}
+
+// slot returns the time stored in slot i.
+func (cb *CircularBuffer) slot(i int) time.Time {
+	var ts int64
+	cb.read(func(r *ring, _ int64) {
+		ts = r.slots[i].Load()
+	})
+	return fromNanos(ts)
+}
+
+// nth returns the time stored in the i-th slot counted from the
+// oldest one.
+func (cb *CircularBuffer) nth(i int) time.Time {
+	var ts int64
+	cb.read(func(r *ring, off int64) {
+		ts = r.slots[(off+int64(i))%int64(len(r.slots))].Load()
+	})
+	return fromNanos(ts)
+}
+
+// offset returns the index of the next slot to be written.
+func (cb *CircularBuffer) offset() int {
+	r, off := cb.load()
+	return int(off % int64(len(r.slots)))
+}
+
+// retire marks r as replaced, such that concurrent readers and writers
+// retry on the new ring, and returns the offset and the slots of r.
+func (r *ring) retire() (int64, []int64) {
+	var off int64
+	for {
+		off = r.offset.Load()
+		if r.offset.CompareAndSwap(off, -1) {
+			break
 		}
-		cb.slots = newSlots
-		cb.offset = 0
 	}
+	slots := make([]int64, len(r.slots))
+	for i := range r.slots {
+		slots[i] = r.slots[i].Swap(frozen)
+	}
+	return off, slots
+}
+
+// reset removes all requests from the buffer and keeps its size.
+func (cb *CircularBuffer) reset() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	old := cb.ring.Load()
+	old.retire()
+	cb.ring.Store(newRing(len(old.slots)))
+}
+
+func (cb *CircularBuffer) resize(n int) error {
+	return cb.reconfigure(n, cb.sustainedWindow())
+}
+
+// reconfigure changes the sustained rate to n per window, which
+// resizes the ring to n plus burst slots. The old ring is retired by
+// setting a negative offset, such that no new slots can be claimed,
+// and each slot is frozen, such that callers of Add, which already
+// claimed a slot, retry on the new ring.
+//
+// The newest min(n+burst, Cap) timestamps are kept in time order and
+// empty slots are put before the oldest kept timestamp, such that the
+// ring is ordered from the offset, which is reset to 0. The new window
+// applies to the kept timestamps, too.
+func (cb *CircularBuffer) reconfigure(n int, window time.Duration) error {
+	if n <= 0 {
+		return &ArgumentError{Name: "size", Value: n}
+	}
+	if window <= 0 {
+		return &ArgumentError{Name: "timeWindow", Value: window}
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.window.Store(int64(window))
+	n += cb.burst
+	old := cb.ring.Load()
+	cur := len(old.slots)
+	if cur == n {
+		return nil
+	}
+	_, slots := old.retire()
+
+	// Slots claimed by a concurrent Add, which did not write its time
+	// yet, hold an expired time or are empty. The Add retries on the
+	// new ring, so sorting treats them as free slots.
+	slices.Sort(slots)
+	// copy the newest k slots in time order to the end of the new ring
+	r := newRing(n)
+	k := min(n, cur)
+	for i := 0; i < k; i++ {
+		r.slots[n-k+i].Store(slots[cur-k+i])
+	}
+	cb.ring.Store(r)
+	return nil
 }
@@ -2,7 +2,9 @@ package circularbuffer
 
 import (
 	"math"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -80,7 +82,7 @@ func TestCurrent(t *testing.T) {
 	for i := 0; i < 2*l; i++ {
 		new := start.Add(time.Duration(i) * window)
 		cb.Add(new)
-		if cb.Current("") != new {
+		if !cb.Current("").Equal(new) {
 			t.Errorf("current position should be the last one added")
 		}
 		time.Sleep(window)
@@ -106,6 +108,9 @@ func TestAdd(t *testing.T) {
 	l := 4
 	window := 1 * time.Second
 	cb := NewCircularBuffer(l, window)
+	if cb.Add(time.Time{}) || cb.Len() != 0 {
+		t.Errorf("Add() of the zero time should return false and add nothing")
+	}
 	if !cb.Add(time.Now()) {
 		t.Errorf("empty buffer Add() should return true")
 	}
@@ -174,6 +179,34 @@ func TestCicularBufferMassiveConcurrentUse(t *testing.T) {
 
 }
 
+func TestCircularBufferConcurrentAddFull(t *testing.T) {
+	// OS threads are preempted between loading the offset and the
+	// slot of Add, even on a single CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	const goroutines, adds = 8, 1 << 17
+	for round := 0; round < 3; round++ {
+		cb := NewCircularBuffer(goroutines*adds, time.Hour)
+		var failed atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				now := time.Now()
+				for j := 0; j < adds; j++ {
+					if !cb.Add(now) {
+						failed.Add(1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if n := failed.Load(); n != 0 {
+			t.Fatalf("expected all adds to fit into the buffer, %d failed", n)
+		}
+	}
+}
+
 func TestResizeBufferIncrease(t *testing.T) {
 	l := 4
 	window := 1 * time.Second
@@ -183,16 +216,20 @@ func TestResizeBufferIncrease(t *testing.T) {
 		cb.Add(start)
 	}
 	cb.resize(2 * l)
+	// empty slots are the oldest, such that the ring stays ordered
 	for i := 0; i < l; i++ {
-		if !cb.slots[i].Equal(start) {
-			t.Errorf("invalid value found in slot %d: %s", i, cb.slots[i])
+		if !cb.nth(i).IsZero() {
+			t.Errorf("invalid value found in slot %d: %s", i, cb.nth(i))
 		}
 	}
 	for i := l; i < 2*l; i++ {
-		if !cb.slots[i].IsZero() {
-			t.Errorf("invalid value found in slot %d: %s", i, cb.slots[i])
+		if !cb.nth(i).Equal(start) {
+			t.Errorf("invalid value found in slot %d: %s", i, cb.nth(i))
 		}
 	}
+	if cb.offset() != 0 {
+		t.Errorf("offset is not 0. Is: %d", cb.offset())
+	}
 }
 
 func TestResizeBufferDecreaseFullVaryingOffset(t *testing.T) {
@@ -201,8 +238,8 @@ func TestResizeBufferDecreaseFullVaryingOffset(t *testing.T) {
 	for off := 0; off < l; off++ {
 		for newSize := 1; newSize < l; newSize++ {
 			cb := NewCircularBuffer(l, window)
-			cb.offset = off
-			start := time.Time{}
+			cb.ring.Load().offset.Store(int64(off))
+			start := time.Now().Add(-time.Hour)
 			for i := 0; i < l; i++ {
 				added := cb.Add(start.Add(time.Duration(i) * window))
 				if !added {
@@ -211,12 +248,12 @@ func TestResizeBufferDecreaseFullVaryingOffset(t *testing.T) {
 			}
 			cb.resize(newSize)
 			for i := 0; i < newSize; i++ {
-				if !cb.slots[i].Equal(start.Add(window * time.Duration(l-newSize+i))) {
-					t.Errorf("invalid value found for new size %d in slot %d: %s", newSize, i, cb.slots[i])
+				if !cb.slot(i).Equal(start.Add(window * time.Duration(l-newSize+i))) {
+					t.Errorf("invalid value found for new size %d in slot %d: %s", newSize, i, cb.slot(i))
 				}
 			}
-			if cb.offset != 0 {
-				t.Errorf("offset is not 0. Is: %d", cb.offset)
+			if cb.offset() != 0 {
+				t.Errorf("offset is not 0. Is: %d", cb.offset())
 			}
 		}
 	}
@@ -240,12 +277,12 @@ func TestResizeBufferDecreaseFullOverwritten(t *testing.T) {
 
 			for i := 0; i < 3; i++ {
 				expected := ts.Add(time.Duration(i+(writes-newSize)) * time.Second)
-				if b.slots[i] != expected {
-					t.Errorf("(%d) Expected %v got %v", i, expected, b.slots[i])
+				if !b.slot(i).Equal(expected) {
+					t.Errorf("(%d) Expected %v got %v", i, expected, b.slot(i))
 				}
 			}
-			if b.offset != 0 {
-				t.Errorf("unexpected offset: %d", b.offset)
+			if b.offset() != 0 {
+				t.Errorf("unexpected offset: %d", b.offset())
 			}
 		}
 	}
@@ -269,13 +306,13 @@ func TestResizeBufferDecreaseNonFull(t *testing.T) {
 			for i := 0; i < newLen; i++ {
 				diff := writes - newSize
 				expected := timestamp.Add(time.Duration(diff+i) * time.Second)
-				if b.slots[i] != expected {
-					t.Errorf("unexpected time: %v expected, %v", b.slots[i].Second(), expected.Second())
+				if !b.slot(i).Equal(expected) {
+					t.Errorf("unexpected time: %v expected, %v", b.slot(i).Second(), expected.Second())
 				}
 			}
 
-			if b.offset != 0 {
-				t.Errorf("unexpected offset: %d", b.offset)
+			if b.offset() != 0 {
+				t.Errorf("unexpected offset: %d", b.offset())
 			}
 		}
 	}
@@ -301,3 +338,112 @@ func TestRetryAfter(t *testing.T) {
 		}
 	}
 }
+
+func TestAddConcurrentNeverExceedsCapacity(t *testing.T) {
+	l := 16
+	window := time.Minute
+	for run := 0; run < 100; run++ {
+		cb := NewCircularBuffer(l, window)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		added := 0
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 2*l; i++ {
+					if cb.Add(time.Now()) {
+						mu.Lock()
+						added++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if added != l {
+			t.Fatalf("run %d: expected %d added, got %d", run, l, added)
+		}
+	}
+}
+
+func TestAddConcurrentResize(t *testing.T) {
+	window := time.Minute
+	cb := NewCircularBuffer(1<<10, window)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1<<8; i++ {
+				if !cb.Add(time.Now()) {
+					t.Errorf("Add should return true")
+				}
+			}
+		}()
+	}
+	for i := 0; i < 16; i++ {
+		cb.resize(1<<10 + i + 1)
+	}
+	wg.Wait()
+	if cb.Len() != 1<<10 {
+		t.Errorf("expected %d, but is %d", 1<<10, cb.Len())
+	}
+}
+
+func BenchmarkCircularBufferAdd(b *testing.B) {
+	cb := NewCircularBuffer(1<<21, time.Second)
+	now := time.Now()
+	for n := 0; n < b.N; n++ {
+		cb.Add(now)
+	}
+}
+
+func TestLenPartiallyExpired(t *testing.T) {
+	l := 8
+	window := time.Minute
+	for off := 0; off < l; off++ {
+		for expired := 0; expired <= l; expired++ {
+			cb := NewCircularBuffer(l, window)
+			cb.ring.Load().offset.Store(int64(off))
+			start := time.Now().Add(-2 * window)
+			for i := 0; i < expired; i++ {
+				cb.Add(start.Add(time.Duration(i) * time.Millisecond))
+			}
+			now := time.Now()
+			for i := expired; i < l; i++ {
+				cb.Add(now.Add(time.Duration(i) * time.Millisecond))
+			}
+			if cb.Len() != l-expired {
+				t.Errorf("offset %d: expected %d, but is %d", off, l-expired, cb.Len())
+			}
+			if cb.Remaining("") != expired {
+				t.Errorf("offset %d: expected %d remaining, but is %d", off, expired, cb.Remaining(""))
+			}
+		}
+	}
+}
+
+func BenchmarkCircularBufferLen(b *testing.B) {
+	cb := NewCircularBuffer(1<<21, time.Second)
+	for i := 0; i < 1<<20; i++ {
+		cb.Add(time.Now())
+	}
+	for n := 0; n < b.N; n++ {
+		cb.Len()
+	}
+}
+
+func TestReset(t *testing.T) {
+	cb := NewCircularBuffer(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		cb.Add(time.Now())
+	}
+	cb.Reset("")
+	if cb.Len() != 0 || cb.Cap() != 3 {
+		t.Errorf("expected empty buffer of size 3, got len %d cap %d", cb.Len(), cb.Cap())
+	}
+	if !cb.Add(time.Now()) {
+		t.Errorf("Add after reset should succeed")
+	}
+}
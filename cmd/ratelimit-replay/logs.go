@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// request is a request of client at time t read from an access log.
+type request struct {
+	t      time.Time
+	client string
+}
+
+// clfTimeLayout is the time format of the common log format.
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// clfPattern matches the host and time of the common and combined log
+// format, for example:
+//
+//	127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.0" 200 2326
+var clfPattern = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\]`)
+
+// logConfig configures how access logs are parsed.
+type logConfig struct {
+	// format is "clf", "jsonl" or "auto", which detects the format
+	// per line.
+	format    string
+	timeField string
+	keyField  string
+}
+
+// readLog reads the requests of the access log r in time order.
+func readLog(r io.Reader, c logConfig) ([]request, error) {
+	var requests []request
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" {
+			continue
+		}
+		format := c.format
+		if format == "auto" {
+			format = "clf"
+			if strings.HasPrefix(text, "{") {
+				format = "jsonl"
+			}
+		}
+
+		var req request
+		var err error
+		switch format {
+		case "clf":
+			req, err = parseCLF(text)
+		case "jsonl":
+			req, err = parseJSON(text, c.timeField, c.keyField)
+		default:
+			return nil, fmt.Errorf("unknown log format: %q", c.format)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		requests = append(requests, req)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sortRequests(requests)
+	return requests, nil
+}
+
+// sortRequests sorts the requests by time and keeps the order of the
+// log for requests at the same time.
+func sortRequests(requests []request) {
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].t.Before(requests[j].t)
+	})
+}
+
+func parseCLF(line string) (request, error) {
+	m := clfPattern.FindStringSubmatch(line)
+	if m == nil {
+		return request{}, fmt.Errorf("invalid common log format: %q", line)
+	}
+	t, err := time.Parse(clfTimeLayout, m[2])
+	if err != nil {
+		return request{}, err
+	}
+	return request{t: t, client: m[1]}, nil
+}
+
+func parseJSON(line, timeField, keyField string) (request, error) {
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &rec); err != nil {
+		return request{}, err
+	}
+	client, ok := rec[keyField].(string)
+	if !ok {
+		return request{}, fmt.Errorf("missing key field %q", keyField)
+	}
+	var t time.Time
+	switch v := rec[timeField].(type) {
+	case string:
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return request{}, err
+		}
+	case float64:
+		sec, frac := math.Modf(v)
+		t = time.Unix(int64(sec), int64(frac*1e9))
+	default:
+		return request{}, fmt.Errorf("missing time field %q", timeField)
+	}
+	return request{t: t, client: client}, nil
+}
+
+// parseDurations parses a comma separated list of durations.
+func parseDurations(s string) ([]time.Duration, error) {
+	var ds []time.Duration
+	for _, f := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// parseInts parses a comma separated list of integers.
+func parseInts(s string) ([]int, error) {
+	var ns []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLog(t *testing.T) {
+	log := `10.0.0.2 - - [10/Oct/2000:13:55:37 -0700] "GET /b HTTP/1.0" 200 10 "-" "curl/8.0"
+10.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /a HTTP/1.0" 200 2326
+
+{"time":"2000-10-10T20:55:38Z","remote_addr":"10.0.0.3"}
+{"time":971211339.5,"remote_addr":"10.0.0.1"}
+`
+	requests, err := readLog(strings.NewReader(log), logConfig{format: "auto", timeField: "time", keyField: "remote_addr"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []request{
+		{time.Date(2000, 10, 10, 20, 55, 36, 0, time.UTC), "10.0.0.1"},
+		{time.Date(2000, 10, 10, 20, 55, 37, 0, time.UTC), "10.0.0.2"},
+		{time.Date(2000, 10, 10, 20, 55, 38, 0, time.UTC), "10.0.0.3"},
+		{time.Date(2000, 10, 10, 20, 55, 39, 5e8, time.UTC), "10.0.0.1"},
+	}
+	if len(requests) != len(want) {
+		t.Fatalf("expected %d requests, got %d", len(want), len(requests))
+	}
+	for i, r := range requests {
+		if !r.t.Equal(want[i].t) || r.client != want[i].client {
+			t.Errorf("request %d: expected %v %s, got %v %s", i, want[i].t, want[i].client, r.t, r.client)
+		}
+	}
+}
+
+func TestReadLogErrors(t *testing.T) {
+	for _, tt := range []struct {
+		format string
+		log    string
+	}{
+		{"clf", `{"time":"2000-10-10T20:55:38Z","remote_addr":"10.0.0.3"}`},
+		{"clf", `10.0.0.1 - - [yesterday] "GET / HTTP/1.0" 200 1`},
+		{"jsonl", `10.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.0" 200 1`},
+		{"jsonl", `{"time":"2000-10-10T20:55:38Z"}`},
+		{"jsonl", `{"remote_addr":"10.0.0.3"}`},
+		{"xml", `<request/>`},
+	} {
+		_, err := readLog(strings.NewReader(tt.log), logConfig{format: tt.format, timeField: "time", keyField: "remote_addr"})
+		if err == nil {
+			t.Errorf("%s: expected error for %q", tt.format, tt.log)
+		}
+	}
+}
+
+func TestParseLists(t *testing.T) {
+	ls, err := parseInts("10, 30,100")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ls) != 3 || ls[0] != 10 || ls[1] != 30 || ls[2] != 100 {
+		t.Errorf("unexpected limits: %v", ls)
+	}
+	ws, err := parseDurations("1s,1m")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ws) != 2 || ws[0] != time.Second || ws[1] != time.Minute {
+		t.Errorf("unexpected windows: %v", ws)
+	}
+	if _, err := parseInts("10,x"); err == nil {
+		t.Error("expected error for invalid limit")
+	}
+	if _, err := parseDurations("1s,"); err == nil {
+		t.Error("expected error for invalid window")
+	}
+}
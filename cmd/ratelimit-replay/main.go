@@ -0,0 +1,78 @@
+// Command ratelimit-replay replays access logs against candidate
+// limits of a ClientRateLimiter with a virtual clock and prints how
+// many requests and clients each candidate would have rejected, such
+// that limits can be picked from data.
+//
+// It reads access logs in common or combined log format, keyed by the
+// remote host, and JSON lines with configurable time and key fields
+// from the given files or stdin.
+//
+// Example:
+//
+//	ratelimit-replay -limits 10,30,100 -windows 1s,10s,1m access.log
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	var (
+		limits    = flag.String("limits", "10,30,100", "comma separated candidate limits")
+		windows   = flag.String("windows", "1s,10s,1m", "comma separated candidate windows")
+		format    = flag.String("format", "auto", "log format: clf (common and combined), jsonl or auto")
+		timeField = flag.String("time-field", "time", "time field of JSON logs, RFC 3339 or unix seconds")
+		keyField  = flag.String("key-field", "remote_addr", "client key field of JSON logs")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [access.log ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(*limits, *windows, logConfig{
+		format:    *format,
+		timeField: *timeField,
+		keyField:  *keyField,
+	}, flag.Args(), os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "ratelimit-replay:", err)
+		os.Exit(1)
+	}
+}
+
+func run(limits, windows string, c logConfig, files []string, w io.Writer) error {
+	ls, err := parseInts(limits)
+	if err != nil {
+		return fmt.Errorf("invalid limits: %w", err)
+	}
+	ws, err := parseDurations(windows)
+	if err != nil {
+		return fmt.Errorf("invalid windows: %w", err)
+	}
+
+	var readers []io.Reader
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	if len(readers) == 0 {
+		readers = append(readers, os.Stdin)
+	}
+	requests, err := readLog(io.MultiReader(readers...), c)
+	if err != nil {
+		return err
+	}
+
+	candidates, err := replay(requests, ls, ws)
+	if err != nil {
+		return err
+	}
+	return writeTable(w, candidates)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	circularbuffer "github.com/szuecs/rate-limit-buffer"
+)
+
+// virtualClock is the Clock of the replayed limiters, which is set to
+// the time of each request. It is safe for concurrent use, because
+// the cleanup goroutines of the limiters read it, too.
+type virtualClock struct {
+	now atomic.Pointer[time.Time]
+}
+
+func (c *virtualClock) Now() time.Time {
+	if t := c.now.Load(); t != nil {
+		return *t
+	}
+	return time.Time{}
+}
+
+func (c *virtualClock) set(t time.Time) {
+	c.now.Store(&t)
+}
+
+// candidate is a limit to evaluate and its result.
+type candidate struct {
+	Limit  int
+	Window time.Duration
+
+	Requests         int
+	RejectedRequests int
+	Clients          int
+	RejectedClients  int
+
+	limiter  *circularbuffer.ClientRateLimiter
+	rejected map[string]struct{}
+}
+
+// replay replays the requests against a ClientRateLimiter per limit
+// and window and returns the candidates sorted by window and limit.
+func replay(requests []request, limits []int, windows []time.Duration) ([]*candidate, error) {
+	clock := &virtualClock{}
+	if len(requests) > 0 {
+		clock.set(requests[0].t)
+	}
+	var candidates []*candidate
+	for _, w := range windows {
+		for _, l := range limits {
+			rl, err := circularbuffer.NewClientRateLimiterWithOptions(l, w, circularbuffer.WithClock(clock))
+			if err != nil {
+				return nil, fmt.Errorf("limit %d per %v: %w", l, w, err)
+			}
+			defer rl.Close()
+			candidates = append(candidates, &candidate{
+				Limit:    l,
+				Window:   w,
+				limiter:  rl,
+				rejected: make(map[string]struct{}),
+			})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Window != candidates[j].Window {
+			return candidates[i].Window < candidates[j].Window
+		}
+		return candidates[i].Limit < candidates[j].Limit
+	})
+
+	ctx := context.Background()
+	clients := make(map[string]struct{})
+	for _, r := range requests {
+		clock.set(r.t)
+		clients[r.client] = struct{}{}
+		for _, c := range candidates {
+			c.Requests++
+			if !c.limiter.Allow(ctx, r.client) {
+				c.RejectedRequests++
+				c.rejected[r.client] = struct{}{}
+			}
+		}
+	}
+	for _, c := range candidates {
+		c.Clients = len(clients)
+		c.RejectedClients = len(c.rejected)
+	}
+	return candidates, nil
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+func writeTable(w io.Writer, candidates []*candidate) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "limit\twindow\trejected requests\t%%\trejected clients\t%%\t\n")
+	for _, c := range candidates {
+		fmt.Fprintf(tw, "%d\t%v\t%d/%d\t%.2f\t%d/%d\t%.2f\t\n",
+			c.Limit, c.Window,
+			c.RejectedRequests, c.Requests, percent(c.RejectedRequests, c.Requests),
+			c.RejectedClients, c.Clients, percent(c.RejectedClients, c.Clients))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var requests []request
+	// a: 10 requests within a second, b: 1 request per second
+	for i := 0; i < 10; i++ {
+		requests = append(requests, request{start.Add(time.Duration(i) * 100 * time.Millisecond), "a"})
+		requests = append(requests, request{start.Add(time.Duration(i) * time.Second), "b"})
+	}
+	sortRequests(requests)
+
+	candidates, err := replay(requests, []int{10, 5}, []time.Duration{10 * time.Second, time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, want := range []candidate{
+		{Limit: 5, Window: time.Second, Requests: 20, RejectedRequests: 5, Clients: 2, RejectedClients: 1},
+		{Limit: 10, Window: time.Second, Requests: 20, RejectedRequests: 0, Clients: 2, RejectedClients: 0},
+		{Limit: 5, Window: 10 * time.Second, Requests: 20, RejectedRequests: 10, Clients: 2, RejectedClients: 2},
+		{Limit: 10, Window: 10 * time.Second, Requests: 20, RejectedRequests: 0, Clients: 2, RejectedClients: 0},
+	} {
+		c := candidates[i]
+		if c.Limit != want.Limit || c.Window != want.Window {
+			t.Fatalf("candidate %d: expected %d/%v, got %d/%v", i, want.Limit, want.Window, c.Limit, c.Window)
+		}
+		if c.Requests != want.Requests || c.RejectedRequests != want.RejectedRequests ||
+			c.Clients != want.Clients || c.RejectedClients != want.RejectedClients {
+			t.Errorf("candidate %d/%v: expected %d/%d requests and %d/%d clients rejected, got %d/%d and %d/%d",
+				c.Limit, c.Window,
+				want.RejectedRequests, want.Requests, want.RejectedClients, want.Clients,
+				c.RejectedRequests, c.Requests, c.RejectedClients, c.Clients)
+		}
+	}
+
+	if _, err := replay(requests, []int{0}, []time.Duration{time.Second}); err == nil {
+		t.Error("expected error for invalid limit")
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeTable(&buf, []*candidate{
+		{Limit: 5, Window: time.Second, Requests: 20, RejectedRequests: 5, Clients: 2, RejectedClients: 1},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := buf.String()
+	for _, s := range []string{"limit", "rejected requests", "5/20", "25.00", "1/2", "50.00"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in output:\n%s", s, out)
+		}
+	}
+}
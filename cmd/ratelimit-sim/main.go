@@ -0,0 +1,108 @@
+// Command ratelimit-sim replays synthetic or recorded traffic through
+// a rate limiter on a virtual clock, to answer questions like "what
+// happens to a client at 50 rps with a limit of 30 per 10s" offline.
+//
+// It reports the accepted and rejected requests as timeline, the
+// decisions per key and percentiles of the duration of the Allow call.
+//
+// Examples:
+//
+//	ratelimit-sim -limit 30 -window 10s -traffic constant -rate 50 -duration 1m
+//	ratelimit-sim -limiter quota -limit 1000 -window 1h -traffic poisson -rate 1 -keys 10 -duration 2h
+//	ratelimit-sim -limit 10 -window 1s -traffic burst -burst-size 20 -burst-interval 5s
+//	ratelimit-sim -limit 30 -window 10s -input requests.csv
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	circularbuffer "github.com/szuecs/rate-limit-buffer"
+)
+
+// newLimiter returns the rate limiter of the given kind with limit
+// requests per window on clock.
+func newLimiter(kind string, limit int, window time.Duration, clock circularbuffer.Clock) (circularbuffer.RateLimiter, error) {
+	switch kind {
+	case "buffer":
+		return circularbuffer.NewCircularBufferWithOptions(limit, window, circularbuffer.WithClock(clock))
+	case "client":
+		return circularbuffer.NewClientRateLimiterWithOptions(limit, window, circularbuffer.WithClock(clock))
+	case "quota":
+		return circularbuffer.NewQuotaLimiter(limit, window, max(window/10, 1), circularbuffer.WithClock(clock))
+	case "penalty":
+		rl, err := circularbuffer.NewClientRateLimiterWithOptions(limit, window, circularbuffer.WithClock(clock))
+		if err != nil {
+			return nil, err
+		}
+		return circularbuffer.NewPenaltyLimiter(rl, limit, window, circularbuffer.WithClock(clock))
+	}
+	return nil, fmt.Errorf("unknown limiter: %q", kind)
+}
+
+func main() {
+	var (
+		kind     = flag.String("limiter", "client", "rate limiter: buffer, client, quota or penalty")
+		limit    = flag.Int("limit", 30, "requests allowed per window")
+		window   = flag.Duration("window", 10*time.Second, "time window of the limit")
+		input    = flag.String("input", "", "recorded traffic as CSV or JSONL (.jsonl) of timestamp and key, overrides -traffic")
+		pattern  = flag.String("traffic", "constant", "synthetic traffic: constant, poisson or burst")
+		rate     = flag.Float64("rate", 50, "requests per second per key of constant and poisson traffic")
+		duration = flag.Duration("duration", time.Minute, "duration of synthetic traffic")
+		keys     = flag.Int("keys", 1, "number of keys of synthetic traffic")
+		size     = flag.Int("burst-size", 50, "requests per burst")
+		interval = flag.Duration("burst-interval", 10*time.Second, "interval between bursts")
+		seed     = flag.Uint64("seed", 1, "random seed of poisson traffic")
+		step     = flag.Duration("step", time.Second, "step of the timeline")
+		format   = flag.String("format", "text", "output format: text or json")
+	)
+	flag.Parse()
+
+	if err := run(*kind, *limit, *window, *input, trafficConfig{
+		pattern:       *pattern,
+		rate:          *rate,
+		duration:      *duration,
+		keys:          *keys,
+		burstSize:     *size,
+		burstInterval: *interval,
+		seed:          *seed,
+	}, *step, *format); err != nil {
+		fmt.Fprintln(os.Stderr, "ratelimit-sim:", err)
+		os.Exit(1)
+	}
+}
+
+func run(kind string, limit int, window time.Duration, input string, tc trafficConfig, step time.Duration, format string) error {
+	if step <= 0 {
+		return fmt.Errorf("invalid step: %v", step)
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format: %q", format)
+	}
+
+	var events []event
+	var err error
+	if input != "" {
+		events, err = readTraffic(input)
+	} else {
+		events, err = generate(tc)
+	}
+	if err != nil {
+		return err
+	}
+
+	clock := newVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	rl, err := newLimiter(kind, limit, window, clock)
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	res := simulate(rl, clock, events, step)
+	if format == "json" {
+		return writeJSON(os.Stdout, res)
+	}
+	return writeText(os.Stdout, res)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	circularbuffer "github.com/szuecs/rate-limit-buffer"
+)
+
+// virtualClock is the Clock of the simulated limiter. It is safe for
+// concurrent use, because the cleanup goroutines of the limiters read
+// it, too.
+type virtualClock struct {
+	start time.Time
+	now   atomic.Int64
+}
+
+func newVirtualClock(start time.Time) *virtualClock {
+	return &virtualClock{start: start}
+}
+
+func (c *virtualClock) Now() time.Time {
+	return c.start.Add(time.Duration(c.now.Load()))
+}
+
+func (c *virtualClock) set(d time.Duration) {
+	c.now.Store(int64(d))
+}
+
+// bucket is a step of the accept/reject timeline.
+type bucket struct {
+	Start    time.Duration `json:"start"`
+	Allowed  int           `json:"allowed"`
+	Rejected int           `json:"rejected"`
+}
+
+// keyStats are the decisions of a key.
+type keyStats struct {
+	Key      string `json:"key"`
+	Requests int    `json:"requests"`
+	Allowed  int    `json:"allowed"`
+	Rejected int    `json:"rejected"`
+	// FirstReject is the time of the first rejected request or -1.
+	FirstReject time.Duration `json:"firstReject"`
+}
+
+// latency are percentiles of the duration of the Allow calls.
+type latency struct {
+	P50  time.Duration `json:"p50"`
+	P90  time.Duration `json:"p90"`
+	P99  time.Duration `json:"p99"`
+	P999 time.Duration `json:"p999"`
+	Max  time.Duration `json:"max"`
+}
+
+// result is the report of a simulation.
+type result struct {
+	Requests int         `json:"requests"`
+	Allowed  int         `json:"allowed"`
+	Rejected int         `json:"rejected"`
+	Timeline []bucket    `json:"timeline"`
+	Keys     []*keyStats `json:"keys"`
+	Latency  latency     `json:"latency"`
+}
+
+// simulate replays the events through rl on the virtual clock and
+// records the decisions in a timeline with the given step.
+func simulate(rl circularbuffer.RateLimiter, clock *virtualClock, events []event, step time.Duration) *result {
+	res := &result{}
+	keys := make(map[string]*keyStats)
+	durations := make([]time.Duration, 0, len(events))
+	ctx := context.Background()
+	for _, e := range events {
+		clock.set(e.at)
+		begin := time.Now()
+		allowed := rl.Allow(ctx, e.key)
+		durations = append(durations, time.Since(begin))
+
+		i := int(e.at / step)
+		for len(res.Timeline) <= i {
+			res.Timeline = append(res.Timeline, bucket{Start: time.Duration(len(res.Timeline)) * step})
+		}
+		ks, ok := keys[e.key]
+		if !ok {
+			ks = &keyStats{Key: e.key, FirstReject: -1}
+			keys[e.key] = ks
+			res.Keys = append(res.Keys, ks)
+		}
+		res.Requests++
+		ks.Requests++
+		if allowed {
+			res.Allowed++
+			ks.Allowed++
+			res.Timeline[i].Allowed++
+		} else {
+			res.Rejected++
+			ks.Rejected++
+			res.Timeline[i].Rejected++
+			if ks.FirstReject < 0 {
+				ks.FirstReject = e.at
+			}
+		}
+	}
+	sort.Slice(res.Keys, func(i, j int) bool {
+		return res.Keys[i].Key < res.Keys[j].Key
+	})
+	res.Latency = percentiles(durations)
+	return res
+}
+
+func percentiles(durations []time.Duration) latency {
+	if len(durations) == 0 {
+		return latency{}
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	p := func(q float64) time.Duration {
+		return durations[int(q*float64(len(durations)-1))]
+	}
+	return latency{
+		P50:  p(0.5),
+		P90:  p(0.9),
+		P99:  p(0.99),
+		P999: p(0.999),
+		Max:  durations[len(durations)-1],
+	}
+}
+
+func rejectRatio(rejected, requests int) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return 100 * float64(rejected) / float64(requests)
+}
+
+func writeJSON(w io.Writer, res *result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
+
+func writeText(w io.Writer, res *result) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "requests\tallowed\trejected\trejected %%\t\n")
+	fmt.Fprintf(tw, "%d\t%d\t%d\t%.1f\t\n", res.Requests, res.Allowed, res.Rejected, rejectRatio(res.Rejected, res.Requests))
+	fmt.Fprintln(tw)
+
+	l := res.Latency
+	fmt.Fprintf(tw, "Allow latency\tp50\tp90\tp99\tp99.9\tmax\t\n")
+	fmt.Fprintf(tw, "\t%v\t%v\t%v\t%v\t%v\t\n", l.P50, l.P90, l.P99, l.P999, l.Max)
+	fmt.Fprintln(tw)
+
+	fmt.Fprintf(tw, "time\tallowed\trejected\t\n")
+	for _, b := range res.Timeline {
+		fmt.Fprintf(tw, "%v\t%d\t%d\t\n", b.Start, b.Allowed, b.Rejected)
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintf(tw, "key\trequests\tallowed\trejected\trejected %%\tfirst reject\t\n")
+	for _, ks := range res.Keys {
+		first := "-"
+		if ks.FirstReject >= 0 {
+			first = ks.FirstReject.String()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f\t%s\t\n", ks.Key, ks.Requests, ks.Allowed, ks.Rejected, rejectRatio(ks.Rejected, ks.Requests), first)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	clock := newVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	rl, err := newLimiter("client", 30, 10*time.Second, clock)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+	events, _ := generate(trafficConfig{pattern: "constant", rate: 50, duration: 20 * time.Second, keys: 1})
+
+	res := simulate(rl, clock, events, time.Second)
+	// 30 requests in the first 0.6s, 30 more after 10s
+	if res.Requests != 1000 || res.Allowed != 60 || res.Rejected != 940 {
+		t.Errorf("unexpected totals %d/%d/%d", res.Requests, res.Allowed, res.Rejected)
+	}
+	if len(res.Timeline) != 20 || res.Timeline[0].Allowed != 30 || res.Timeline[0].Rejected != 20 || res.Timeline[10].Allowed != 30 {
+		t.Errorf("unexpected timeline %+v", res.Timeline)
+	}
+	if len(res.Keys) != 1 || res.Keys[0].FirstReject != 600*time.Millisecond {
+		t.Errorf("unexpected key stats %+v", res.Keys[0])
+	}
+	if res.Latency.Max < res.Latency.P50 || res.Latency.P50 <= 0 {
+		t.Errorf("unexpected latency %+v", res.Latency)
+	}
+
+	var buf bytes.Buffer
+	if err := writeText(&buf, res); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "key-0") {
+		t.Errorf("text report should contain key-0:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := writeJSON(&buf, res); err != nil || !strings.Contains(buf.String(), `"firstReject": 600000000`) {
+		t.Errorf("unexpected JSON report %v:\n%s", err, buf.String())
+	}
+}
+
+func TestNewLimiter(t *testing.T) {
+	clock := newVirtualClock(time.Now())
+	for _, kind := range []string{"buffer", "client", "quota", "penalty"} {
+		rl, err := newLimiter(kind, 1, time.Second, clock)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", kind, err)
+			continue
+		}
+		rl.Close()
+	}
+	if _, err := newLimiter("token", 1, time.Second, clock); err == nil {
+		t.Errorf("expected error for unknown limiter")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// event is a request of key at offset at from the start of the
+// simulation.
+type event struct {
+	at  time.Duration
+	key string
+}
+
+// trafficConfig configures a synthetic traffic pattern.
+type trafficConfig struct {
+	pattern  string
+	rate     float64 // requests per second per key
+	duration time.Duration
+	keys     int
+	// burst pattern
+	burstSize     int
+	burstInterval time.Duration
+	seed          uint64
+}
+
+// generate returns the events of the synthetic traffic pattern in
+// time order.
+func generate(c trafficConfig) ([]event, error) {
+	if c.keys <= 0 {
+		return nil, fmt.Errorf("invalid number of keys: %d", c.keys)
+	}
+	if c.duration <= 0 {
+		return nil, fmt.Errorf("invalid duration: %v", c.duration)
+	}
+	rnd := rand.New(rand.NewPCG(c.seed, c.seed))
+	var events []event
+	for k := 0; k < c.keys; k++ {
+		key := "key-" + strconv.Itoa(k)
+		switch c.pattern {
+		case "constant":
+			if c.rate <= 0 {
+				return nil, fmt.Errorf("invalid rate: %v", c.rate)
+			}
+			interval := time.Duration(float64(time.Second) / c.rate)
+			// spread the keys within one interval
+			phase := interval * time.Duration(k) / time.Duration(c.keys)
+			for at := phase; at < c.duration; at += max(interval, 1) {
+				events = append(events, event{at: at, key: key})
+			}
+		case "poisson":
+			if c.rate <= 0 {
+				return nil, fmt.Errorf("invalid rate: %v", c.rate)
+			}
+			for at := expInterval(rnd, c.rate); at < c.duration; at += expInterval(rnd, c.rate) {
+				events = append(events, event{at: at, key: key})
+			}
+		case "burst":
+			if c.burstSize <= 0 || c.burstInterval <= 0 {
+				return nil, fmt.Errorf("invalid burst: %d per %v", c.burstSize, c.burstInterval)
+			}
+			for at := time.Duration(0); at < c.duration; at += c.burstInterval {
+				for i := 0; i < c.burstSize; i++ {
+					events = append(events, event{at: at, key: key})
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown traffic pattern: %q", c.pattern)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].at < events[j].at
+	})
+	return events, nil
+}
+
+// expInterval returns an exponentially distributed interval between
+// the requests of a poisson process with the given rate per second.
+func expInterval(rnd *rand.Rand, rate float64) time.Duration {
+	return time.Duration(math.Max(1, rnd.ExpFloat64()/rate*float64(time.Second)))
+}
+
+// readTraffic reads recorded traffic from path. Files ending with
+// .jsonl or .json are read as JSON lines {"timestamp": ..., "key": ...},
+// all other files as CSV with the columns timestamp and key and an
+// optional header.
+func readTraffic(path string) ([]event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".json":
+		return readJSONL(f)
+	}
+	return readCSV(f)
+}
+
+func readCSV(r io.Reader) ([]event, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+	var times []time.Time
+	var keys []string
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseTimestamp(rec[0])
+		if err != nil {
+			if line == 1 {
+				// header
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		times = append(times, t)
+		keys = append(keys, rec[1])
+	}
+	return toEvents(times, keys), nil
+}
+
+func readJSONL(r io.Reader) ([]event, error) {
+	var times []time.Time
+	var keys []string
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for line := 1; s.Scan(); line++ {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		var rec struct {
+			Timestamp json.RawMessage `json:"timestamp"`
+			Key       string          `json:"key"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ts := string(rec.Timestamp)
+		if unquoted, err := strconv.Unquote(ts); err == nil {
+			ts = unquoted
+		}
+		t, err := parseTimestamp(ts)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		times = append(times, t)
+		keys = append(keys, rec.Key)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return toEvents(times, keys), nil
+}
+
+// parseTimestamp parses RFC 3339 timestamps and unix timestamps in
+// seconds with optional fraction.
+func parseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp: %q", s)
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// toEvents returns the events in time order relative to the first
+// timestamp.
+func toEvents(times []time.Time, keys []string) []event {
+	if len(times) == 0 {
+		return nil
+	}
+	first := times[0]
+	for _, t := range times {
+		if t.Before(first) {
+			first = t
+		}
+	}
+	events := make([]event, len(times))
+	for i, t := range times {
+		events[i] = event{at: t.Sub(first), key: keys[i]}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].at < events[j].at
+	})
+	return events
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, tt := range []struct {
+		c    trafficConfig
+		want int
+	}{
+		{trafficConfig{pattern: "constant", rate: 50, duration: 10 * time.Second, keys: 2}, 1000},
+		{trafficConfig{pattern: "burst", burstSize: 5, burstInterval: time.Second, duration: 10 * time.Second, keys: 1}, 50},
+	} {
+		events, err := generate(tt.c)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.c.pattern, err)
+		}
+		if len(events) != tt.want {
+			t.Errorf("%s: expected %d events, got %d", tt.c.pattern, tt.want, len(events))
+		}
+		for i := 1; i < len(events); i++ {
+			if events[i].at < events[i-1].at {
+				t.Fatalf("%s: events not in time order at %d", tt.c.pattern, i)
+			}
+		}
+	}
+
+	events, err := generate(trafficConfig{pattern: "poisson", rate: 100, duration: 100 * time.Second, keys: 1, seed: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := len(events); n < 9500 || n > 10500 {
+		t.Errorf("expected about 10000 poisson events, got %d", n)
+	}
+
+	for _, c := range []trafficConfig{
+		{pattern: "constant", rate: 0, duration: time.Second, keys: 1},
+		{pattern: "burst", duration: time.Second, keys: 1},
+		{pattern: "sine", rate: 1, duration: time.Second, keys: 1},
+		{pattern: "constant", rate: 1, duration: time.Second, keys: 0},
+	} {
+		if _, err := generate(c); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
+
+func TestReadTraffic(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"requests.csv":   "timestamp,key\n1704067201.5,b\n2024-01-01T00:00:00Z,a\n",
+		"requests.jsonl": `{"timestamp": "2024-01-01T00:00:00Z", "key": "a"}` + "\n\n" + `{"timestamp": 1704067201.5, "key": "b"}` + "\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		events, err := readTraffic(path)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if len(events) != 2 || events[0] != (event{0, "a"}) || events[1] != (event{1500 * time.Millisecond, "b"}) {
+			t.Errorf("%s: unexpected events %v", name, events)
+		}
+	}
+
+	path := filepath.Join(dir, "invalid.csv")
+	os.WriteFile(path, []byte("1,a\nyesterday,b\n"), 0o644)
+	if _, err := readTraffic(path); err == nil {
+		t.Errorf("expected error for invalid timestamp")
+	}
+}
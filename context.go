@@ -0,0 +1,135 @@
+package circularbuffer
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type contextKey int
+
+const (
+	keyContextKey contextKey = iota
+	costContextKey
+	priorityContextKey
+	decisionContextKey
+)
+
+// ContextWithKey returns a copy of ctx carrying key. Allow of a
+// KeyedLimiter[K] uses it, if it is called with the zero key.
+func ContextWithKey[K comparable](ctx context.Context, key K) context.Context {
+	return context.WithValue(ctx, keyContextKey, key)
+}
+
+// KeyFromContext returns the key of type K attached by ContextWithKey.
+func KeyFromContext[K comparable](ctx context.Context) (K, bool) {
+	key, ok := ctx.Value(keyContextKey).(K)
+	return key, ok
+}
+
+// keyOf returns s or, if s is the zero key, the key attached to ctx.
+func keyOf[K comparable](ctx context.Context, s K) K {
+	var zero K
+	if s == zero {
+		if key, ok := KeyFromContext[K](ctx); ok {
+			return key
+		}
+	}
+	return s
+}
+
+// ContextWithCost returns a copy of ctx carrying the cost of a
+// request, which is the number of hits Allow consumes at once. A
+// request with a cost is allowed only if all hits are free. Costs
+// below 1 are ignored.
+func ContextWithCost(ctx context.Context, cost int) context.Context {
+	return context.WithValue(ctx, costContextKey, cost)
+}
+
+// CostFromContext returns the cost attached by ContextWithCost, it
+// defaults to 1.
+func CostFromContext(ctx context.Context) int {
+	if cost, ok := ctx.Value(costContextKey).(int); ok && cost > 0 {
+		return cost
+	}
+	return 1
+}
+
+// ContextWithPriority returns a copy of ctx carrying the priority of
+// a request, which is used by PriorityLimiter.Allow.
+func ContextWithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityContextKey, p)
+}
+
+// PriorityFromContext returns the priority attached by
+// ContextWithPriority.
+func PriorityFromContext(ctx context.Context) (Priority, bool) {
+	p, ok := ctx.Value(priorityContextKey).(Priority)
+	return p, ok
+}
+
+// Decision is the decision of a rate limiter recorded in a context
+// created by ContextWithDecision.
+type Decision struct {
+	Allowed bool
+	Key     string
+	Cost    int
+	// Remaining is the number of requests allowed after the
+	// decision.
+	Remaining int
+	// RetryAfter is the number of seconds until the next request
+	// is allowed.
+	RetryAfter int
+}
+
+type decisionRecorder struct {
+	decision atomic.Pointer[Decision]
+}
+
+// ContextWithDecision returns a copy of ctx, which records the
+// decision of every Allow called with it. Wrapping rate limiters, for
+// example a ListLimiter, record their decision after the wrapped rate
+// limiter, such that the outermost decision is kept. Use
+// DecisionFromContext to read it, for example in a downstream handler.
+func ContextWithDecision(ctx context.Context) context.Context {
+	return context.WithValue(ctx, decisionContextKey, &decisionRecorder{})
+}
+
+// DecisionFromContext returns the last decision recorded in ctx. It
+// returns false if ctx was not created by ContextWithDecision or no
+// decision was recorded yet.
+func DecisionFromContext(ctx context.Context) (Decision, bool) {
+	if r := recorderFrom(ctx); r != nil {
+		if d := r.decision.Load(); d != nil {
+			return *d, true
+		}
+	}
+	return Decision{}, false
+}
+
+// recorderFrom returns the decisionRecorder of ctx or nil.
+func recorderFrom(ctx context.Context) *decisionRecorder {
+	r, _ := ctx.Value(decisionContextKey).(*decisionRecorder)
+	return r
+}
+
+func (r *decisionRecorder) record(d Decision) {
+	r.decision.Store(&d)
+}
+
+// recordDecision records the decision of rl for key s in ctx, if ctx
+// records decisions. Remaining and RetryAfter are only computed, if
+// the decision is recorded.
+func recordDecision(ctx context.Context, rl interface {
+	Remaining(string) int
+	RetryAfter(string) int
+}, s string, allowed bool) {
+	if r := recorderFrom(ctx); r != nil {
+		r.record(Decision{
+			Allowed:    allowed,
+			Key:        s,
+			Cost:       CostFromContext(ctx),
+			Remaining:  rl.Remaining(s),
+			RetryAfter: rl.RetryAfter(s),
+		})
+	}
+}
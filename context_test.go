@@ -0,0 +1,163 @@
+package circularbuffer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAllowContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cb := NewCircularBuffer(1, time.Minute)
+	rl, _ := NewClientRateLimiterWithOptions(1, time.Minute)
+	defer rl.Close()
+	for _, l := range []RateLimiter{cb, rl, NewListLimiter(cb, nil, nil)} {
+		if l.Allow(ctx, "foo") {
+			t.Errorf("%T: done context should not be allowed", l)
+		}
+		if l.Remaining("foo") != 1 {
+			t.Errorf("%T: done context should not be counted", l)
+		}
+	}
+}
+
+func TestAllowContextKey(t *testing.T) {
+	rl, _ := NewKeyedLimiter[int](1, time.Minute)
+	defer rl.Close()
+
+	ctx := ContextWithKey(t.Context(), 42)
+	if k, ok := KeyFromContext[int](ctx); !ok || k != 42 {
+		t.Errorf("expected key 42, got %d", k)
+	}
+	if _, ok := KeyFromContext[string](ctx); ok {
+		t.Errorf("key of other type should not be found")
+	}
+
+	if !rl.Allow(ctx, 0) {
+		t.Errorf("first request should be allowed")
+	}
+	if rl.Remaining(42) != 0 || rl.Remaining(0) != 1 {
+		t.Errorf("request should be counted for the key of the context")
+	}
+	if !rl.Allow(ctx, 7) {
+		t.Errorf("explicit key should have precedence")
+	}
+}
+
+func TestAllowContextCost(t *testing.T) {
+	clock := newFakeClock()
+	rl, _ := NewClientRateLimiterWithOptions(5, time.Minute, WithClock(clock))
+	defer rl.Close()
+	ql, _ := NewQuotaLimiter(5, time.Hour, time.Minute, WithClock(clock))
+	defer ql.Close()
+
+	for _, l := range []RateLimiter{rl, ql} {
+		ctx := ContextWithCost(t.Context(), 3)
+		if !l.Allow(ctx, "foo") {
+			t.Errorf("%T: request of cost 3 should be allowed", l)
+		}
+		if n := l.Remaining("foo"); n != 2 {
+			t.Errorf("%T: expected 2 remaining, got %d", l, n)
+		}
+		if l.Allow(ctx, "foo") {
+			t.Errorf("%T: request of cost 3 should not be allowed with 2 remaining", l)
+		}
+		if n := l.Remaining("foo"); n != 2 {
+			t.Errorf("%T: rejected request should not be counted, got %d remaining", l, n)
+		}
+		if !l.Allow(ContextWithCost(t.Context(), 0), "foo") {
+			t.Errorf("%T: cost 0 should count as 1", l)
+		}
+	}
+
+	cb := NewCircularBuffer(2, time.Minute)
+	if cb.Allow(ContextWithCost(t.Context(), 3), "") {
+		t.Errorf("cost above capacity should never be allowed")
+	}
+}
+
+func TestAllowContextPriority(t *testing.T) {
+	pl, err := NewPriorityLimiter(10, time.Minute, []float64{0.5, 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pl.Close()
+
+	for i := 0; i < 5; i++ {
+		pl.Allow(t.Context(), "")
+	}
+	if pl.Allow(t.Context(), "") {
+		t.Errorf("lowest priority should be limited to 5")
+	}
+	ctx := ContextWithPriority(t.Context(), 1)
+	if p, ok := PriorityFromContext(ctx); !ok || p != 1 {
+		t.Errorf("expected priority 1, got %d", p)
+	}
+	if !pl.Allow(ctx, "") {
+		t.Errorf("priority 1 should be allowed")
+	}
+}
+
+func TestAllowContextDecision(t *testing.T) {
+	rl, _ := NewClientRateLimiterWithOptions(2, time.Minute)
+	deny, _ := NewAccessList("bad")
+	l := NewListLimiter(rl, nil, deny)
+	defer l.Close()
+
+	if _, ok := DecisionFromContext(t.Context()); ok {
+		t.Errorf("context without recorder should not have a decision")
+	}
+	ctx := ContextWithDecision(t.Context())
+	if _, ok := DecisionFromContext(ctx); ok {
+		t.Errorf("context should not have a decision before Allow")
+	}
+
+	l.Allow(ctx, "foo")
+	d, ok := DecisionFromContext(ctx)
+	if !ok || !d.Allowed || d.Key != "foo" || d.Cost != 1 || d.Remaining != 1 || d.RetryAfter != 0 {
+		t.Errorf("unexpected decision %+v", d)
+	}
+
+	l.Allow(ContextWithKey(ctx, "bad"), "")
+	d, _ = DecisionFromContext(ctx)
+	if d.Allowed || d.Key != "bad" || d.Remaining != 0 {
+		t.Errorf("expected denied decision, got %+v", d)
+	}
+
+	l.Allow(ctx, "foo")
+	l.Allow(ctx, "foo")
+	d, _ = DecisionFromContext(ctx)
+	if d.Allowed || d.RetryAfter != 60 {
+		t.Errorf("expected rate limited decision, got %+v", d)
+	}
+}
+
+func TestAddNConcurrentNeverExceedsCapacity(t *testing.T) {
+	cb := NewCircularBuffer(100, time.Hour)
+	ctx := ContextWithCost(t.Context(), 3)
+	done := make(chan int)
+	for i := 0; i < 8; i++ {
+		go func(cost bool) {
+			n := 0
+			for j := 0; j < 100; j++ {
+				if cost {
+					if cb.Allow(ctx, "") {
+						n += 3
+					}
+				} else if cb.Allow(t.Context(), "") {
+					n++
+				}
+			}
+			done <- n
+		}(i%2 == 0)
+	}
+	total := 0
+	for i := 0; i < 8; i++ {
+		total += <-done
+	}
+	if total > 100 || cb.Len() != total {
+		t.Errorf("expected at most 100 hits counted in %d slots, got %d", cb.Len(), total)
+	}
+}
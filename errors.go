@@ -0,0 +1,44 @@
+package circularbuffer
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidArgument is returned, wrapped by an
+	// *ArgumentError, if a constructor or method was called with
+	// an invalid value.
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrKeyNotFound is returned by methods that work on the state
+	// of a single key, if the key is unknown to the RateLimiter.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrQueueFull is returned by FairQueue.Wait, if the queue of
+	// the client is full.
+	ErrQueueFull = errors.New("queue full")
+
+	// ErrClosed is returned by methods of a closed rate limiter.
+	ErrClosed = errors.New("rate limiter closed")
+)
+
+// ArgumentError is the error returned for an invalid argument Name
+// with the given Value. It can be matched by errors.Is(err,
+// ErrInvalidArgument).
+type ArgumentError struct {
+	Name  string
+	Value interface{}
+}
+
+func (e *ArgumentError) Error() string {
+	return fmt.Sprintf("%v %s: %v", ErrInvalidArgument, e.Name, e.Value)
+}
+
+func (e *ArgumentError) Unwrap() error {
+	return ErrInvalidArgument
+}
+
+func keyNotFound(s string) error {
+	return fmt.Errorf("%w: %q", ErrKeyNotFound, s)
+}
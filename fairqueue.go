@@ -0,0 +1,300 @@
+package circularbuffer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// FairQueue is a queueing front-end for a shared RateLimiter, for
+// example created by NewRateLimiter to protect a backend. Requests,
+// that can not pass the RateLimiter immediately, wait in a bounded
+// queue per client. Free slots are released to the clients in
+// weighted round-robin order (deficit round robin with a cost of 1
+// per request), such that a noisy client can not starve the others by
+// polling faster. The RateLimiter is called without holding the lock
+// of the FairQueue, such that it may block, for example with
+// WithMaxDelay.
+type FairQueue struct {
+	mu      sync.Mutex
+	limiter RateLimiter
+	depth   int
+	timeout time.Duration
+	queues  map[string]*clientQueue
+	weights map[string]int
+	active  []*clientQueue
+	cur     int
+	closed  bool
+	wakeCH  chan struct{}
+	quitCH  chan struct{}
+}
+
+type clientQueue struct {
+	client  string
+	weight  int
+	deficit int
+	waiters []*waiter
+}
+
+type waiter struct {
+	// ctx carries the values of the context of Wait, like the cost
+	// and the key, to the RateLimiter, but not its cancellation
+	ctx     context.Context
+	ready   chan struct{}
+	granted bool
+	err     error
+}
+
+// NewFairQueue returns a FairQueue in front of rl with at most depth
+// waiting requests per client. Requests wait at most timeout, if
+// timeout is > 0, in addition to the deadline of their context.
+func NewFairQueue(rl RateLimiter, depth int, timeout time.Duration) (*FairQueue, error) {
+	if depth <= 0 {
+		return nil, &ArgumentError{Name: "depth", Value: depth}
+	}
+	fq := &FairQueue{
+		limiter: rl,
+		depth:   depth,
+		timeout: timeout,
+		queues:  make(map[string]*clientQueue),
+		weights: make(map[string]int),
+		wakeCH:  make(chan struct{}, 1),
+		quitCH:  make(chan struct{}),
+	}
+	go fq.dispatch()
+	return fq, nil
+}
+
+// SetWeight sets the weight of client, which is the number of
+// requests released in a row per round. The default weight is 1.
+func (fq *FairQueue) SetWeight(client string, weight int) error {
+	if weight <= 0 {
+		return &ArgumentError{Name: "weight", Value: weight}
+	}
+	fq.mu.Lock()
+	fq.weights[client] = weight
+	if q, ok := fq.queues[client]; ok {
+		q.weight = weight
+	}
+	fq.mu.Unlock()
+	return nil
+}
+
+// Wait blocks until the request of client is allowed by the
+// RateLimiter. It returns ErrQueueFull, if the queue of client is
+// full, the error of ctx, if ctx is done or the timeout expired
+// before, and ErrClosed, if the FairQueue was closed.
+func (fq *FairQueue) Wait(ctx context.Context, client string) error {
+	fq.mu.Lock()
+	if fq.closed {
+		fq.mu.Unlock()
+		return ErrClosed
+	}
+	// nobody is waiting, so nobody is overtaken
+	if len(fq.active) == 0 {
+		fq.mu.Unlock()
+		if fq.limiter.Allow(ctx, client) {
+			return nil
+		}
+		fq.mu.Lock()
+		if fq.closed {
+			fq.mu.Unlock()
+			return ErrClosed
+		}
+	}
+	q, ok := fq.queues[client]
+	if !ok {
+		q = &clientQueue{client: client, weight: fq.weight(client)}
+		fq.queues[client] = q
+	}
+	if len(q.waiters) >= fq.depth {
+		fq.mu.Unlock()
+		return ErrQueueFull
+	}
+	if len(q.waiters) == 0 {
+		fq.active = append(fq.active, q)
+	}
+	w := &waiter{ctx: context.WithoutCancel(ctx), ready: make(chan struct{})}
+	q.waiters = append(q.waiters, w)
+	fq.mu.Unlock()
+
+	select {
+	case fq.wakeCH <- struct{}{}:
+	default:
+	}
+
+	if fq.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fq.timeout)
+		defer cancel()
+	}
+	select {
+	case <-w.ready:
+		return w.err
+	case <-ctx.Done():
+	}
+
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if w.granted {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	fq.remove(q, w)
+	return ctx.Err()
+}
+
+// needs to be called with mu held by caller
+func (fq *FairQueue) weight(client string) int {
+	if w, ok := fq.weights[client]; ok {
+		return w
+	}
+	return 1
+}
+
+// remove removes the waiter w from q and q from the active queues, if
+// it is empty.
+// needs to be called with mu held by caller
+func (fq *FairQueue) remove(q *clientQueue, w *waiter) {
+	for i := range q.waiters {
+		if q.waiters[i] == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			break
+		}
+	}
+	if len(q.waiters) == 0 {
+		fq.deactivate(q)
+	}
+}
+
+// needs to be called with mu held by caller
+func (fq *FairQueue) deactivate(q *clientQueue) {
+	for i := range fq.active {
+		if fq.active[i] == q {
+			fq.active = append(fq.active[:i], fq.active[i+1:]...)
+			if i < fq.cur {
+				fq.cur--
+			}
+			break
+		}
+	}
+	if fq.cur >= len(fq.active) {
+		fq.cur = 0
+	}
+	q.deficit = 0
+	delete(fq.queues, q.client)
+}
+
+// next returns the queue, that is served next in deficit round robin
+// order.
+// needs to be called with mu held by caller
+func (fq *FairQueue) next() *clientQueue {
+	if len(fq.active) == 0 {
+		return nil
+	}
+	q := fq.active[fq.cur]
+	if q.deficit <= 0 {
+		q.deficit = q.weight
+	}
+	return q
+}
+
+// release grants the first waiter of q and advances the round robin.
+// needs to be called with mu held by caller
+func (fq *FairQueue) release(q *clientQueue) {
+	w := q.waiters[0]
+	q.waiters = q.waiters[1:]
+	w.granted = true
+	close(w.ready)
+
+	q.deficit--
+	if len(q.waiters) == 0 {
+		fq.deactivate(q)
+	} else if q.deficit <= 0 {
+		fq.cur = (fq.cur + 1) % len(fq.active)
+	}
+}
+
+// retryAfter returns how long the dispatcher sleeps, if the
+// RateLimiter is exhausted.
+func (fq *FairQueue) retryAfter() time.Duration {
+	if cb, ok := fq.limiter.(*CircularBuffer); ok {
+		return max(cb.retryAfter(), time.Microsecond)
+	}
+	return 10 * time.Millisecond
+}
+
+func (fq *FairQueue) dispatch() {
+	for {
+		fq.mu.Lock()
+		q := fq.next()
+		if q == nil {
+			fq.mu.Unlock()
+			select {
+			case <-fq.quitCH:
+				return
+			case <-fq.wakeCH:
+			}
+			continue
+		}
+		w := q.waiters[0]
+		fq.mu.Unlock()
+
+		if fq.limiter.Allow(w.ctx, q.client) {
+			fq.mu.Lock()
+			if !fq.closed {
+				// if w was canceled while calling the RateLimiter,
+				// the hit goes to the next waiter of q or, if q was
+				// deactivated, of the next queue
+				if len(q.waiters) == 0 || fq.queues[q.client] != q {
+					q = fq.next()
+				}
+				if q != nil {
+					fq.release(q)
+				}
+			}
+			fq.mu.Unlock()
+			continue
+		}
+
+		timer := time.NewTimer(fq.retryAfter())
+		select {
+		case <-fq.quitCH:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Len returns the number of waiting requests of client.
+func (fq *FairQueue) Len(client string) int {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if q, ok := fq.queues[client]; ok {
+		return len(q.waiters)
+	}
+	return 0
+}
+
+// Close stops the FairQueue, all waiting requests return ErrClosed.
+// The RateLimiter is not closed.
+func (fq *FairQueue) Close() {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if fq.closed {
+		return
+	}
+	fq.closed = true
+	close(fq.quitCH)
+	for _, q := range fq.active {
+		for _, w := range q.waiters {
+			w.err = ErrClosed
+			close(w.ready)
+		}
+	}
+	fq.active = nil
+	fq.queues = make(map[string]*clientQueue)
+}
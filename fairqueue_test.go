@@ -0,0 +1,239 @@
+package circularbuffer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// enqueue starts n waiting requests of client and waits until they
+// are queued.
+func enqueue(t *testing.T, fq *FairQueue, client string, n int, order chan<- string, wg *sync.WaitGroup) {
+	t.Helper()
+	queued := fq.Len(client)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fq.Wait(context.Background(), client); err != nil {
+				t.Errorf("%s: unexpected error: %v", client, err)
+				return
+			}
+			order <- client
+		}()
+	}
+	for fq.Len(client) < queued+n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	window := 100 * time.Millisecond
+	rl := NewRateLimiter(1, window)
+	fq, err := NewFairQueue(rl, 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fq.Close()
+
+	if err := fq.Wait(t.Context(), "noisy"); err != nil {
+		t.Fatalf("first request should pass immediately: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	order := make(chan string, 10)
+	enqueue(t, fq, "noisy", 3, order, &wg)
+	enqueue(t, fq, "quiet", 1, order, &wg)
+	wg.Wait()
+	close(order)
+
+	var got []string
+	for c := range order {
+		got = append(got, c)
+	}
+	if s := strings.Join(got, ","); s != "noisy,quiet,noisy,noisy" {
+		t.Errorf("unexpected order: %s", s)
+	}
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	rl := NewRateLimiter(1, 50*time.Millisecond)
+	fq, err := NewFairQueue(rl, 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fq.Close()
+	if err := fq.SetWeight("a", 2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rl.Allow(t.Context(), "")
+
+	var wg sync.WaitGroup
+	order := make(chan string, 10)
+	enqueue(t, fq, "a", 4, order, &wg)
+	enqueue(t, fq, "b", 2, order, &wg)
+	wg.Wait()
+	close(order)
+
+	var got []string
+	for c := range order {
+		got = append(got, c)
+	}
+	if s := strings.Join(got, ","); s != "a,a,b,a,a,b" {
+		t.Errorf("unexpected order: %s", s)
+	}
+}
+
+func TestFairQueueBoundsAndTimeout(t *testing.T) {
+	rl := NewRateLimiter(1, time.Minute)
+	fq, err := NewFairQueue(rl, 1, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fq.Close()
+	rl.Allow(t.Context(), "")
+
+	errCH := make(chan error)
+	go func() { errCH <- fq.Wait(context.Background(), "foo") }()
+	for fq.Len("foo") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := fq.Wait(t.Context(), "foo"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+	if err := <-errCH; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if n := fq.Len("foo"); n != 0 {
+		t.Errorf("timed out request should be removed, got %d", n)
+	}
+}
+
+func TestFairQueueCost(t *testing.T) {
+	rl := NewRateLimiter(4, time.Minute)
+	fq, err := NewFairQueue(rl, 1, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fq.Close()
+
+	ctx := ContextWithCost(t.Context(), 3)
+	if err := fq.Wait(ctx, "foo"); err != nil {
+		t.Fatalf("first request should pass immediately: %v", err)
+	}
+	// the queued request needs 3 hits, but only 1 is left
+	if err := fq.Wait(ctx, "foo"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if n := rl.Remaining(""); n != 1 {
+		t.Errorf("expected 1 remaining, got %d", n)
+	}
+}
+
+func TestFairQueueBlockingLimiter(t *testing.T) {
+	cb, err := NewCircularBufferWithOptions(10, time.Second, WithMinInterval(200*time.Millisecond), WithMaxDelay(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fq, err := NewFairQueue(cb, 1, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fq.Close()
+
+	if err := fq.Wait(t.Context(), "foo"); err != nil {
+		t.Fatalf("first request should pass immediately: %v", err)
+	}
+	errCH := make(chan error)
+	go func() { errCH <- fq.Wait(context.Background(), "foo") }()
+	time.Sleep(20 * time.Millisecond)
+
+	// the second request is delayed by the RateLimiter, but does not
+	// block the FairQueue
+	begin := time.Now()
+	fq.Len("foo")
+	if d := time.Since(begin); d > 100*time.Millisecond {
+		t.Errorf("expected Len not to wait for the RateLimiter, took %v", d)
+	}
+	if err := <-errCH; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// blockingLimiter is a RateLimiter, whose Allow blocks until the test
+// sends its result.
+type blockingLimiter struct {
+	RateLimiter
+	calls  chan struct{}
+	result chan bool
+}
+
+func (l *blockingLimiter) Allow(context.Context, string) bool {
+	l.calls <- struct{}{}
+	return <-l.result
+}
+
+func TestFairQueueCancelDuringAllow(t *testing.T) {
+	rl := &blockingLimiter{RateLimiter: NewRateLimiter(1, time.Second), calls: make(chan struct{}), result: make(chan bool)}
+	fq, err := NewFairQueue(rl, 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fq.Close()
+	defer close(rl.result)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	canceled := make(chan error)
+	go func() { canceled <- fq.Wait(ctx, "foo") }()
+	// reject the request without waiters, it is queued
+	<-rl.calls
+	rl.result <- false
+	// the dispatcher calls Allow for the queued request
+	<-rl.calls
+
+	granted := make(chan error)
+	go func() { granted <- fq.Wait(context.Background(), "foo") }()
+	for fq.Len("foo") != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	rl.result <- true
+
+	select {
+	case err := <-granted:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the hit of the canceled request should be released to the next one")
+		<-rl.calls
+	}
+}
+
+func TestFairQueueClose(t *testing.T) {
+	rl := NewRateLimiter(1, time.Minute)
+	fq, err := NewFairQueue(rl, 1, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rl.Allow(t.Context(), "")
+
+	errCH := make(chan error)
+	go func() { errCH <- fq.Wait(context.Background(), "foo") }()
+	for fq.Len("foo") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	fq.Close()
+	if err := <-errCH; !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if err := fq.Wait(t.Context(), "foo"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
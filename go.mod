@@ -1,3 +1,5 @@
 module github.com/szuecs/rate-limit-buffer
 
 go 1.24.3
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,157 @@
+package circularbuffer
+
+import (
+	"context"
+	"hash/maphash"
+	"math"
+	"strings"
+	"sync"
+)
+
+// Level is a named level of a HierarchicalLimiter.
+type Level struct {
+	Name    string
+	Limiter *ClientRateLimiter
+}
+
+// HierarchicalLimiter does rate limiting on nested levels, for example
+// organizations containing users hitting endpoints, with limits like
+// "org <= 1000/min, each user <= 100/min, each user per endpoint <=
+// 20/min". A request carries a key path, one key per level, and is
+// only allowed if every level allows it. Hits are consumed at every
+// level or at none.
+//
+// The key of a level is the key path up to this level, such that
+// user "bob" of org "a" and of org "b" are counted independently. The
+// Limiters of the levels must not be used by other callers, because
+// they could break the atomicity of consumption.
+type HierarchicalLimiter struct {
+	levels []Level
+	seed   maphash.Seed
+	locks  [64]sync.Mutex
+}
+
+// NewHierarchicalLimiter returns a HierarchicalLimiter of the given
+// levels, starting with the outermost level. It returns an
+// *ArgumentError if no level is given, a level has no Limiter or a
+// Limiter uses the Smoothed algorithm or WithMinInterval, which are
+// not supported.
+func NewHierarchicalLimiter(levels ...Level) (*HierarchicalLimiter, error) {
+	if len(levels) == 0 {
+		return nil, &ArgumentError{Name: "levels", Value: len(levels)}
+	}
+	for _, l := range levels {
+		if l.Limiter == nil {
+			return nil, &ArgumentError{Name: "level " + l.Name, Value: l.Limiter}
+		}
+		if err := l.Limiter.conf.validateUnsmoothed(); err != nil {
+			return nil, err
+		}
+	}
+	return &HierarchicalLimiter{
+		levels: levels,
+		seed:   maphash.MakeSeed(),
+	}, nil
+}
+
+// keys returns the key of each level for the given path. Keys are
+// only returned for levels with a path element.
+func (h *HierarchicalLimiter) keys(path []string) []string {
+	n := min(len(path), len(h.levels))
+	keys := make([]string, n)
+	for i := 0; i < n; i++ {
+		keys[i] = strings.Join(path[:i+1], "\x00")
+	}
+	return keys
+}
+
+// AllowPath returns true if all levels allow the request with the
+// given key path and consumes a hit at every level. A request with a
+// cost attached by ContextWithCost needs as many hits at every level.
+// If the request is rate limited, it returns false and the Level that
+// denied it, which is the outermost denying level. Levels without path
+// element are skipped. If ctx is done, it returns false and no Level.
+// If ctx was created by ContextWithDecision, the Decision is recorded
+// with the key of the denying or the innermost level.
+func (h *HierarchicalLimiter) AllowPath(ctx context.Context, path ...string) (bool, *Level) {
+	if ctx.Err() != nil {
+		return false, nil
+	}
+	if len(path) == 0 {
+		return true, nil
+	}
+	keys := h.keys(path)
+	cost := CostFromContext(ctx)
+
+	// all paths of a root key share a lock, so checking and
+	// consuming all levels is atomic
+	mu := &h.locks[maphash.String(h.seed, path[0])%uint64(len(h.locks))]
+	mu.Lock()
+	defer mu.Unlock()
+
+	buffers := make([]*CircularBuffer, len(keys))
+	for i, k := range keys {
+		l := &h.levels[i]
+		cb, ok := l.Limiter.buffer(k)
+		if !ok || !cb.fits(l.Limiter.conf.clock.Now(), cost) {
+			l.Limiter.rejected(k)
+			h.record(ctx, k, false, path)
+			return false, l
+		}
+		buffers[i] = cb
+	}
+	for i, cb := range buffers {
+		l := &h.levels[i]
+		// fails only if the Limiter is used by other callers, then
+		// the outer levels are consumed already
+		if !cb.addN(l.Limiter.conf.clock.Now(), cost) {
+			l.Limiter.rejected(keys[i])
+			h.record(ctx, keys[i], false, path)
+			return false, l
+		}
+		l.Limiter.allowed(keys[i])
+	}
+	h.record(ctx, keys[len(keys)-1], true, path)
+	return true, nil
+}
+
+// record records the decision of AllowPath in ctx, if ctx records
+// decisions.
+func (h *HierarchicalLimiter) record(ctx context.Context, k string, allowed bool, path []string) {
+	if r := recorderFrom(ctx); r != nil {
+		r.record(Decision{
+			Allowed:    allowed,
+			Key:        k,
+			Cost:       CostFromContext(ctx),
+			Remaining:  h.RemainingPath(path...),
+			RetryAfter: h.RetryAfterPath(path...),
+		})
+	}
+}
+
+// RetryAfterPath returns how many seconds one should wait until the
+// next request with the given key path is allowed by all levels.
+func (h *HierarchicalLimiter) RetryAfterPath(path ...string) int {
+	retryAfter := 0
+	for i, k := range h.keys(path) {
+		retryAfter = max(retryAfter, h.levels[i].Limiter.RetryAfter(k))
+	}
+	return retryAfter
+}
+
+// RemainingPath returns how many requests with the given key path are
+// allowed by all levels until it will be rate limited.
+func (h *HierarchicalLimiter) RemainingPath(path ...string) int {
+	remaining := math.MaxInt
+	for i, k := range h.keys(path) {
+		remaining = min(remaining, h.levels[i].Limiter.Remaining(k))
+	}
+	return remaining
+}
+
+// Close closes the Limiters of all levels.
+func (h *HierarchicalLimiter) Close() {
+	for _, l := range h.levels {
+		l.Limiter.Close()
+	}
+}
@@ -0,0 +1,190 @@
+package circularbuffer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestHierarchy(t *testing.T, clock Clock, limits ...int) *HierarchicalLimiter {
+	t.Helper()
+	names := []string{"org", "user", "endpoint"}
+	var levels []Level
+	for i, n := range limits {
+		rl, err := NewClientRateLimiterWithOptions(n, time.Minute, WithClock(clock))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		levels = append(levels, Level{Name: names[i], Limiter: rl})
+	}
+	h, err := NewHierarchicalLimiter(levels...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return h
+}
+
+func TestHierarchicalLimiterDeniedLevel(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHierarchy(t, clock, 5, 3, 2)
+	defer h.Close()
+
+	for i := 0; i < 2; i++ {
+		if ok, l := h.AllowPath(t.Context(), "acme", "bob", "/search"); !ok {
+			t.Fatalf("request %d should not be rate limitted by %s", i, l.Name)
+		}
+	}
+	ok, l := h.AllowPath(t.Context(), "acme", "bob", "/search")
+	if ok || l.Name != "endpoint" {
+		t.Fatalf("expected endpoint to deny, got %v %v", ok, l)
+	}
+	if ok, _ := h.AllowPath(t.Context(), "acme", "bob", "/books"); !ok {
+		t.Fatalf("other endpoint should not be rate limitted")
+	}
+	ok, l = h.AllowPath(t.Context(), "acme", "bob", "/books")
+	if ok || l.Name != "user" {
+		t.Fatalf("expected user to deny, got %v %v", ok, l)
+	}
+	if ok, _ := h.AllowPath(t.Context(), "acme", "alice", "/search"); !ok {
+		t.Fatalf("other user should not be rate limitted")
+	}
+	if ok, _ := h.AllowPath(t.Context(), "acme", "carol"); !ok {
+		t.Fatalf("path without endpoint should not be rate limitted")
+	}
+	ok, l = h.AllowPath(t.Context(), "acme", "carol", "/search")
+	if ok || l.Name != "org" {
+		t.Fatalf("expected org to deny, got %v %v", ok, l)
+	}
+	if ok, _ := h.AllowPath(t.Context(), "other", "bob", "/search"); !ok {
+		t.Fatalf("user of other org should not be rate limitted")
+	}
+
+	// rejected requests consume nothing
+	if n := h.RemainingPath("acme", "carol", "/search"); n != 0 {
+		t.Errorf("expected 0 remaining, got %d", n)
+	}
+	if n := h.levels[1].Limiter.Remaining("acme\x00carol"); n != 2 {
+		t.Errorf("rejected request should not consume the user level, remaining %d", n)
+	}
+	if n := h.RetryAfterPath("acme", "bob", "/books"); n != 60 {
+		t.Errorf("expected retry after 60s, got %d", n)
+	}
+
+	clock.Advance(time.Minute + time.Nanosecond)
+	if ok, l := h.AllowPath(t.Context(), "acme", "bob", "/search"); !ok {
+		t.Fatalf("should not be rate limitted after the window by %s", l.Name)
+	}
+}
+
+func TestHierarchicalLimiterCost(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHierarchy(t, clock, 10, 10)
+	defer h.Close()
+
+	ctx := ContextWithCost(t.Context(), 5)
+	var allowed int
+	for i := 0; i < 10; i++ {
+		if ok, _ := h.AllowPath(ctx, "acme", "bob"); ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("expected 2 requests of cost 5 to be allowed, got %d", allowed)
+	}
+	if n := h.levels[0].Limiter.Remaining("acme"); n != 0 {
+		t.Errorf("expected cost to be consumed at the org level, remaining %d", n)
+	}
+
+	ctx = ContextWithDecision(ContextWithCost(t.Context(), 1))
+	ok, l := h.AllowPath(ctx, "acme", "alice")
+	d, recorded := DecisionFromContext(ctx)
+	if ok || !recorded {
+		t.Fatalf("expected a recorded rejection, got %v %v", ok, recorded)
+	}
+	if d.Allowed || d.Key != "acme" || l.Name != "org" || d.Cost != 1 || d.RetryAfter != 60 {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+
+	clock.Advance(time.Minute + time.Nanosecond)
+	ok, _ = h.AllowPath(ctx, "acme", "alice")
+	if d, _ := DecisionFromContext(ctx); !ok || !d.Allowed || d.Key != "acme\x00alice" || d.Remaining != 9 {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+}
+
+func TestHierarchicalLimiterWindowBoundary(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHierarchy(t, clock, 1)
+	defer h.Close()
+
+	if ok, _ := h.AllowPath(t.Context(), "acme"); !ok {
+		t.Fatalf("first request should not be rate limitted")
+	}
+	// a request exactly one window old is still counted like by Allow
+	clock.Advance(time.Minute)
+	for i := 0; i < 10; i++ {
+		ctx := ContextWithDecision(t.Context())
+		if ok, l := h.AllowPath(ctx, "acme"); ok || l.Name != "org" {
+			t.Fatalf("request %d should be rate limitted at the window boundary", i)
+		}
+		if d, ok := DecisionFromContext(ctx); !ok || d.Allowed {
+			t.Errorf("expected a recorded rejection, got %+v", d)
+		}
+	}
+	clock.Advance(time.Nanosecond)
+	if ok, _ := h.AllowPath(t.Context(), "acme"); !ok {
+		t.Errorf("request should not be rate limitted after the window")
+	}
+	if ok, _ := h.AllowPath(t.Context(), "acme"); ok {
+		t.Errorf("second request should be rate limitted")
+	}
+}
+
+func TestHierarchicalLimiterConcurrentAtomic(t *testing.T) {
+	h := newTestHierarchy(t, systemClock{}, 100, 10)
+	defer h.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if ok, _ := h.AllowPath(t.Context(), "acme", user); ok {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}
+		}(string(rune('a' + g)))
+	}
+	wg.Wait()
+	if allowed != 100 {
+		t.Errorf("expected 100 allowed requests, got %d", allowed)
+	}
+	if n := h.levels[0].Limiter.Remaining("acme"); n != 0 {
+		t.Errorf("expected org to be exhausted, remaining %d", n)
+	}
+}
+
+func TestHierarchicalLimiterInvalid(t *testing.T) {
+	if _, err := NewHierarchicalLimiter(); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	if _, err := NewHierarchicalLimiter(Level{Name: "org"}); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	for _, opt := range []Option{WithAlgorithm(Smoothed), WithMinInterval(time.Second)} {
+		rl, err := NewClientRateLimiterWithOptions(10, time.Minute, opt)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := NewHierarchicalLimiter(Level{Name: "org", Limiter: rl}); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("expected ErrInvalidArgument for a smoothed level, got %v", err)
+		}
+		rl.Close()
+	}
+}
@@ -0,0 +1,456 @@
+package circularbuffer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyedLimiter does rate limiting based on the key passed to
+// Allow(). Each key is counted and rate limited independently by its
+// own CircularBuffer. K can be any comparable type, for example a
+// struct of tenant and route, such that callers do not need to format
+// keys into strings. ClientRateLimiter is the KeyedLimiter with
+// string keys, that implements the RateLimiter interface.
+//
+// The buffers are kept in a Store, a MapStore by default, see
+// WithStore.
+type KeyedLimiter[K comparable] struct {
+	sync.RWMutex
+	store      Store[K]
+	keys       atomic.Int64 // number of keys counted against maxKeys
+	maxHits    int
+	timeWindow time.Duration
+	maxKeys    int
+	conf       *config
+	wheel      *timingWheel[K] // guarded by the write lock
+	quitCH     chan struct{}
+}
+
+// NewKeyedLimiter returns a new initialized KeyedLimiter with maxHits
+// per time.Duration d for each key, configured by opts. It returns an
+// *ArgumentError if maxHits, d or an option are invalid.
+func NewKeyedLimiter[K comparable](maxHits int, d time.Duration, opts ...Option) (*KeyedLimiter[K], error) {
+	c, err := newConfig(maxHits, d, opts)
+	if err != nil {
+		return nil, err
+	}
+	store, err := storeOf[K](c)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyedLimiter(c, store), nil
+}
+
+// storeOf returns the Store set by WithStore or a new MapStore.
+func storeOf[K comparable](c *config) (Store[K], error) {
+	if c.store == nil {
+		return NewMapStore[K](), nil
+	}
+	store, ok := c.store.(Store[K])
+	if !ok {
+		return nil, &ArgumentError{Name: "store", Value: c.store}
+	}
+	return store, nil
+}
+
+// keyString returns the string passed to Hooks for key k.
+func keyString[K comparable](k K) string {
+	if s, ok := any(k).(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
+
+func newKeyedLimiter[K comparable](c *config, store Store[K]) *KeyedLimiter[K] {
+	window := slotWindow(c.maxHits, c.burst, c.timeWindow)
+	crl := &KeyedLimiter[K]{
+		store:      store,
+		maxHits:    c.maxHits,
+		timeWindow: window,
+		maxKeys:    c.maxKeys,
+		conf:       c,
+		wheel:      newTimingWheel[K](window, c.clock.Now()),
+		quitCH:     make(chan struct{}),
+	}
+	// keys of a store set by WithStore expire like keys created by
+	// a request, after their newest request plus the time window
+	var n int64
+	store.Range(func(k K, cb *CircularBuffer) bool {
+		n++
+		crl.wheel.schedule(expiry[K]{
+			key:      k,
+			cb:       cb,
+			deadline: cb.current().Add(cb.timeWindow()),
+		})
+		return true
+	})
+	crl.keys.Store(n)
+	go crl.startCleanerDaemon(c.cleanInterval)
+	return crl
+}
+
+// Allow tries to add s to a circularbuffer and returns true if we have
+// a free bucket, if not it will return false, which means ratelimit with an additional
+// context.Context.
+//
+// The key can be attached to ctx by ContextWithKey, if s is the zero
+// key, and a cost by ContextWithCost. If ctx is done, Allow returns
+// false without counting the request. If ctx was created by
+// ContextWithDecision, the Decision is recorded in it. With a maximum
+// delay, see WithMaxDelay, Allow blocks until an early request of s
+// is due.
+func (rl *KeyedLimiter[K]) Allow(ctx context.Context, s K) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	s = keyOf(ctx, s)
+	cost := CostFromContext(ctx)
+	source, ok := rl.buffer(s)
+	allowed := ok && source.take(ctx, cost)
+	if r := recorderFrom(ctx); r != nil {
+		r.record(Decision{
+			Allowed:    allowed,
+			Key:        keyString(s),
+			Cost:       cost,
+			Remaining:  rl.Remaining(s),
+			RetryAfter: rl.RetryAfter(s),
+		})
+	}
+	if allowed {
+		return rl.allowed(s)
+	}
+	return rl.rejected(s)
+}
+
+// buffer returns the CircularBuffer of s and creates it, if it does
+// not exist. It returns false if the buffer would exceed maxKeys.
+func (rl *KeyedLimiter[K]) buffer(s K) (*CircularBuffer, bool) {
+	if source, present := rl.store.Get(s); present {
+		return source, true
+	}
+	source, created := rl.store.GetOrCreate(s, func() *CircularBuffer {
+		if n := rl.keys.Add(1); rl.maxKeys > 0 && n > int64(rl.maxKeys) {
+			rl.keys.Add(-1)
+			return nil
+		}
+		return rl.conf.newCircularBuffer()
+	})
+	if source == nil {
+		return nil, false
+	}
+	if created {
+		rl.Lock()
+		rl.wheel.schedule(expiry[K]{
+			key:      s,
+			cb:       source,
+			deadline: rl.conf.clock.Now().Add(rl.timeWindow),
+		})
+		rl.Unlock()
+	}
+	return source, true
+}
+
+// allowed calls the OnAllow hook and returns true. The key is only
+// converted to a string, if the hook is set.
+func (rl *KeyedLimiter[K]) allowed(s K) bool {
+	if rl.conf.hooks.OnAllow != nil {
+		rl.conf.hooks.allow(keyString(s))
+	}
+	return true
+}
+
+// rejected calls the OnReject hook and returns false.
+func (rl *KeyedLimiter[K]) rejected(s K) bool {
+	if rl.conf.hooks.OnReject != nil {
+		rl.conf.hooks.reject(keyString(s))
+	}
+	return false
+}
+
+// Oldest returns the time of the oldest request of s in its buffer.
+// With a burst, see WithBurst, the buffer stores the times the
+// requests are scheduled at, which can be in the future.
+func (rl *KeyedLimiter[K]) Oldest(s K) time.Time {
+	cb, present := rl.store.Get(s)
+	if !present {
+		return time.Time{}
+	}
+	return cb.Next()
+}
+
+// Current returns the time of the newest request of s.
+// With a burst, see WithBurst, the buffer stores the times the
+// requests are scheduled at, which can be in the future.
+func (rl *KeyedLimiter[K]) Current(s K) time.Time {
+	cb, present := rl.store.Get(s)
+	if !present {
+		return time.Time{}
+	}
+	return cb.current()
+}
+
+// Delta returns the diffence between the current and the oldest value in
+// the buffer, i.e. maxHits / Delta() => rate. With a burst, it is the
+// span of the requests at the sustained rate, see CircularBuffer.Delta.
+func (rl *KeyedLimiter[K]) Delta(s K) time.Duration {
+	cb, present := rl.store.Get(s)
+	if !present {
+		return time.Duration(time.Hour * 24)
+	}
+	return cb.delta()
+}
+
+// Resize resizes the given circular buffer to the given size. Resizing to a size
+// <= 0 is not performed and returns an *ArgumentError. Resizing an
+// unknown client returns ErrKeyNotFound.
+func (rl *KeyedLimiter[K]) Resize(s K, n int) error {
+	cb, present := rl.store.Get(s)
+	if !present {
+		return keyNotFound(keyString(s))
+	}
+	return cb.resize(n)
+}
+
+// Reconfigure changes the number of allowed hits and the time window
+// of the key s, see CircularBuffer.Reconfigure. The configuration of
+// the key is kept until the key is removed or expires, new keys use
+// the configuration of the KeyedLimiter. Reconfiguring an unknown key
+// returns ErrKeyNotFound.
+func (rl *KeyedLimiter[K]) Reconfigure(s K, maxHits int, window time.Duration) error {
+	cb, present := rl.store.Get(s)
+	if !present {
+		return keyNotFound(keyString(s))
+	}
+	return cb.reconfigure(maxHits, window)
+}
+
+// Charge consumes cost additional requests of the key s, for example
+// after a request was allowed and its actual cost, like the CPU time
+// or the response size, is known. If the key has not enough capacity
+// left, it goes into debt and its following requests are rate limited
+// until the debt left the time window. An unknown key, for example one
+// that expired while the request was processed, is created like by
+// Allow. Charge returns ErrKeyNotFound, if the key can not be created,
+// because the limit of WithMaxKeys is reached, and an *ArgumentError
+// for a cost <= 0.
+func (rl *KeyedLimiter[K]) Charge(s K, cost int) error {
+	if cost <= 0 {
+		return &ArgumentError{Name: "cost", Value: cost}
+	}
+	cb, ok := rl.buffer(s)
+	if !ok {
+		return keyNotFound(keyString(s))
+	}
+	cb.charge(rl.conf.clock.Now(), cost)
+	return nil
+}
+
+// RetryAfter returns how many seconds one should wait until the next request
+// is allowed.
+func (rl *KeyedLimiter[K]) RetryAfter(s K) int {
+	cb, present := rl.store.Get(s)
+	if !present {
+		return 0
+	}
+	return cb.RetryAfter("")
+}
+
+// Remaining returns how many requests of the client s are allowed
+// until it will be rate limited.
+func (rl *KeyedLimiter[K]) Remaining(s K) int {
+	cb, present := rl.store.Get(s)
+	if !present {
+		return rl.maxHits + rl.conf.burst
+	}
+	return cb.Remaining("")
+}
+
+// KeyInfo is the state of a key of a rate limiter.
+type KeyInfo struct {
+	// Len is the number of requests within the time window.
+	Len int `json:"len"`
+	// Cap is the number of requests allowed within the time window.
+	Cap int `json:"cap"`
+	// Oldest is the time of the request, that has to leave the
+	// time window before the next request is allowed. With a
+	// burst, see WithBurst, Oldest and Current are the times the
+	// requests are scheduled at, which can be in the future.
+	Oldest time.Time `json:"oldest,omitzero"`
+	// Current is the time of the newest request.
+	Current time.Time `json:"current,omitzero"`
+	// Delta is the duration between Oldest and Current.
+	Delta time.Duration `json:"delta"`
+	// RetryAfter is the number of seconds until the next request is
+	// allowed.
+	RetryAfter int `json:"retryAfter"`
+	// Remaining is the number of requests allowed until the key is
+	// rate limited.
+	Remaining int `json:"remaining"`
+}
+
+func (cb *CircularBuffer) info() KeyInfo {
+	return KeyInfo{
+		Len:        cb.Len(),
+		Cap:        cb.Cap(),
+		Oldest:     cb.Next(),
+		Current:    cb.current(),
+		Delta:      cb.delta(),
+		RetryAfter: cb.RetryAfter(""),
+		Remaining:  cb.Remaining(""),
+	}
+}
+
+// Keys returns all keys with state, in no particular order.
+func (rl *KeyedLimiter[K]) Keys() []K {
+	keys := make([]K, 0, rl.store.Len())
+	rl.store.Range(func(k K, _ *CircularBuffer) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+// Range calls f with the state of every key until f returns false.
+// It works on a snapshot of the keys, f is called without holding a
+// lock and may call methods of the KeyedLimiter.
+func (rl *KeyedLimiter[K]) Range(f func(K, KeyInfo) bool) {
+	var keys []K
+	var buffers []*CircularBuffer
+	rl.store.Range(func(k K, cb *CircularBuffer) bool {
+		keys = append(keys, k)
+		buffers = append(buffers, cb)
+		return true
+	})
+	for i, k := range keys {
+		if !f(k, buffers[i].info()) {
+			return
+		}
+	}
+}
+
+// info returns the state of the key s.
+func (rl *KeyedLimiter[K]) info(s K) (KeyInfo, bool) {
+	cb, present := rl.store.Get(s)
+	if !present {
+		return KeyInfo{}, false
+	}
+	return cb.info(), true
+}
+
+// Reset removes all requests of the key s and keeps its size, for
+// example after a successful login. Unknown keys are ignored.
+func (rl *KeyedLimiter[K]) Reset(s K) {
+	rl.reset(s)
+}
+
+// reset removes all requests of the key s and keeps its size.
+func (rl *KeyedLimiter[K]) reset(s K) error {
+	cb, present := rl.store.Get(s)
+	if !present {
+		return keyNotFound(keyString(s))
+	}
+	cb.reset()
+	return nil
+}
+
+// Remove removes the state of the key s, including a size set by
+// Resize, and calls the OnEvict hook. It returns false if s is
+// unknown.
+func (rl *KeyedLimiter[K]) Remove(s K) bool {
+	present := rl.store.Delete(s)
+	if present {
+		rl.keys.Add(-1)
+	}
+	if present && rl.conf.hooks.OnEvict != nil {
+		rl.conf.hooks.evict(keyString(s))
+	}
+	return present
+}
+
+// expire removes the keys without request within the time window,
+// which are due in the timing wheel. A key is scheduled at creation to
+// expire one time window later and rescheduled to its newest request
+// plus the time window, if it is still in use when it is due. The lock
+// is released after every slot of the wheel, such that requests are
+// not blocked by a scan of all keys.
+func (rl *KeyedLimiter[K]) expire() {
+	now := rl.conf.clock.Now()
+	var evicted []K
+	for {
+		rl.Lock()
+		entries, ok := rl.wheel.due(now)
+		for _, e := range entries {
+			rl.store.Update(e.key, func(cb *CircularBuffer) *CircularBuffer {
+				if cb != e.cb {
+					// removed or replaced since it was scheduled
+					return cb
+				}
+				if deadline := cb.current().Add(cb.timeWindow()); deadline.After(now) {
+					e.deadline = deadline
+					rl.wheel.schedule(e)
+					return cb
+				}
+				rl.keys.Add(-1)
+				if rl.conf.hooks.OnEvict != nil {
+					evicted = append(evicted, e.key)
+				}
+				return nil
+			})
+		}
+		rl.Unlock()
+		if !ok {
+			break
+		}
+	}
+	for _, k := range evicted {
+		rl.conf.hooks.evict(keyString(k))
+	}
+}
+
+// DeleteOld removes old entries from the store by scanning all keys.
+// The cleanup goroutine removes old entries incrementally, such that
+// DeleteOld does not need to be called.
+func (rl *KeyedLimiter[K]) DeleteOld() {
+	var old []K
+	rl.store.Range(func(k K, cb *CircularBuffer) bool {
+		if !cb.InUse() {
+			old = append(old, k)
+		}
+		return true
+	})
+	var evicted []K
+	for _, k := range old {
+		rl.store.Update(k, func(cb *CircularBuffer) *CircularBuffer {
+			if cb == nil || cb.InUse() {
+				return cb
+			}
+			rl.keys.Add(-1)
+			if rl.conf.hooks.OnEvict != nil {
+				evicted = append(evicted, k)
+			}
+			return nil
+		})
+	}
+	for _, k := range evicted {
+		rl.conf.hooks.evict(keyString(k))
+	}
+}
+
+// Close will stop the cleanup goroutine
+func (rl *KeyedLimiter[K]) Close() {
+	close(rl.quitCH)
+}
+
+func (rl *KeyedLimiter[K]) startCleanerDaemon(d time.Duration) {
+	for {
+		select {
+		case <-rl.quitCH:
+			return
+		case <-time.After(d):
+			rl.expire()
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package circularbuffer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type tenantRoute struct {
+	tenant int
+	route  string
+}
+
+func TestKeyedLimiterAllow(t *testing.T) {
+	clock := newFakeClock()
+	window := time.Second
+	rl, err := NewKeyedLimiter[tenantRoute](2, window, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	foo := tenantRoute{tenant: 1, route: "/foo"}
+	bar := tenantRoute{tenant: 1, route: "/bar"}
+	for _, k := range []tenantRoute{foo, bar} {
+		if !rl.Allow(t.Context(), k) || !rl.Allow(t.Context(), k) {
+			t.Errorf("%v should not be rate limitted", k)
+		}
+		if rl.Allow(t.Context(), k) {
+			t.Errorf("%v should be rate limitted", k)
+		}
+		if n := rl.RetryAfter(k); n != 1 {
+			t.Errorf("%v: expected retry after 1s, got %d", k, n)
+		}
+	}
+
+	clock.Advance(window + time.Nanosecond)
+	rl.DeleteOld()
+	if rl.store.Len() != 0 {
+		t.Errorf("expected all keys to be deleted, got %d", rl.store.Len())
+	}
+	if !rl.Allow(t.Context(), foo) {
+		t.Errorf("%v should not be rate limitted after the window", foo)
+	}
+}
+
+func TestKeyedLimiterHookKeys(t *testing.T) {
+	var rejected []string
+	rl, err := NewKeyedLimiter[tenantRoute](1, time.Minute, WithHooks(Hooks{
+		OnReject: func(key string) { rejected = append(rejected, key) },
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	k := tenantRoute{tenant: 42, route: "/login"}
+	rl.Allow(t.Context(), k)
+	rl.Allow(t.Context(), k)
+	if len(rejected) != 1 || rejected[0] != "{42 /login}" {
+		t.Errorf("unexpected rejected keys: %v", rejected)
+	}
+}
+
+func BenchmarkKeyedLimiterAllowStructKey(b *testing.B) {
+	rl, err := NewKeyedLimiter[tenantRoute](10, time.Second)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	m := 100
+	keys := make([]tenantRoute, m)
+	for i := range keys {
+		keys[i] = tenantRoute{tenant: i, route: "/foo"}
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		rl.Allow(b.Context(), keys[n%m])
+	}
+	rl.Close()
+}
+
+func TestKeyedLimiterResetRemove(t *testing.T) {
+	var evicted []string
+	rl, err := NewClientRateLimiterWithOptions(2, time.Minute, WithHooks(Hooks{
+		OnEvict: func(key string) { evicted = append(evicted, key) },
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	rl.Allow(t.Context(), "foo")
+	rl.Allow(t.Context(), "foo")
+	if err := rl.Resize("foo", 3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rl.Reset("foo")
+	if n := rl.Remaining("foo"); n != 3 {
+		t.Errorf("expected reset to keep size 3, got remaining %d", n)
+	}
+	rl.Reset("bar")
+	if keys := rl.Keys(); len(keys) != 1 || keys[0] != "foo" {
+		t.Errorf("expected keys [foo], got %v", keys)
+	}
+
+	if !rl.Remove("foo") {
+		t.Errorf("foo should be removed")
+	}
+	if rl.Remove("foo") {
+		t.Errorf("foo should be unknown")
+	}
+	if len(evicted) != 1 || evicted[0] != "foo" {
+		t.Errorf("expected OnEvict for foo, got %v", evicted)
+	}
+	if n := rl.Remaining("foo"); n != 2 {
+		t.Errorf("expected removed key to have default size, got remaining %d", n)
+	}
+}
+
+func TestKeyedLimiterRange(t *testing.T) {
+	rl, err := NewKeyedLimiter[int](3, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+	for k := 1; k <= 3; k++ {
+		for i := 0; i < k; i++ {
+			rl.Allow(t.Context(), k)
+		}
+	}
+
+	seen := make(map[int]KeyInfo)
+	rl.Range(func(k int, info KeyInfo) bool {
+		seen[k] = info
+		// calling back into the limiter must not deadlock
+		rl.Remaining(k)
+		return true
+	})
+	for k := 1; k <= 3; k++ {
+		if info := seen[k]; info.Len != k || info.Cap != 3 || info.Remaining != 3-k {
+			t.Errorf("%d: unexpected info %+v", k, info)
+		}
+	}
+
+	n := 0
+	rl.Range(func(int, KeyInfo) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("expected Range to stop after 1 key, got %d", n)
+	}
+}
+
+func TestKeyedLimiterCharge(t *testing.T) {
+	clock := newFakeClock()
+	rl, err := NewClientRateLimiterWithOptions(10, time.Second, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	if !rl.Allow(t.Context(), "foo") {
+		t.Fatalf("foo should not be rate limitted")
+	}
+	if err := rl.Charge("foo", 0); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	if err := rl.Charge("foo", 4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := rl.Remaining("foo"); n != 5 {
+		t.Errorf("expected 5 remaining, got %d", n)
+	}
+
+	// 5 requests of debt are charged at the end of the window
+	if err := rl.Charge("foo", 10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rl.Allow(t.Context(), "foo") {
+		t.Errorf("foo should be rate limitted in debt")
+	}
+	if n := rl.RetryAfter("foo"); n != 1 {
+		t.Errorf("expected retry after 1s, got %d", n)
+	}
+
+	clock.Advance(time.Second + time.Nanosecond)
+	for i := 0; i < 5; i++ {
+		if !rl.Allow(t.Context(), "foo") {
+			t.Errorf("request %d should not be rate limitted after the window", i)
+		}
+	}
+	if rl.Allow(t.Context(), "foo") {
+		t.Errorf("foo should be rate limitted by the debt")
+	}
+	if n := rl.RetryAfter("foo"); n != 1 {
+		t.Errorf("expected retry after 1s, got %d", n)
+	}
+
+	clock.Advance(time.Second)
+	if !rl.Allow(t.Context(), "foo") {
+		t.Errorf("foo should not be rate limitted after the debt")
+	}
+}
+
+func TestKeyedLimiterEvictHook(t *testing.T) {
+	clock := newFakeClock()
+	var rl *ClientRateLimiter
+	var remaining []int
+	rl, err := NewClientRateLimiterWithOptions(2, time.Second, WithClock(clock),
+		WithHooks(Hooks{OnEvict: func(s string) { remaining = append(remaining, rl.Remaining(s)) }}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	rl.Allow(t.Context(), "foo")
+	rl.Allow(t.Context(), "bar")
+	clock.Advance(2 * time.Second)
+	rl.expire()
+	rl.Allow(t.Context(), "foo")
+	clock.Advance(2 * time.Second)
+	rl.DeleteOld()
+	if len(remaining) != 3 {
+		t.Errorf("expected OnEvict to be called 3 times, got %v", remaining)
+	}
+}
+
+func TestKeyedLimiterChargeExpired(t *testing.T) {
+	clock := newFakeClock()
+	rl, err := NewClientRateLimiterWithOptions(2, 50*time.Millisecond, WithClock(clock), WithMaxKeys(1))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	if !rl.Allow(t.Context(), "foo") {
+		t.Fatalf("foo should not be rate limitted")
+	}
+	// the request takes longer than the window and foo expires
+	clock.Advance(150 * time.Millisecond)
+	rl.expire()
+	if _, ok := rl.store.Get("foo"); ok {
+		t.Fatalf("foo should be expired")
+	}
+	if err := rl.Charge("foo", 3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rl.Allow(t.Context(), "foo") {
+		t.Errorf("foo should be rate limitted by the debt")
+	}
+	if err := rl.Charge("bar", 1); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound above the maximum keys, got %v", err)
+	}
+}
+
+func TestKeyedLimiterChargeLarge(t *testing.T) {
+	clock := newFakeClock()
+	rl, err := NewClientRateLimiterWithOptions(10, time.Second, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+	rl.Allow(t.Context(), "foo")
+
+	begin := time.Now()
+	if err := rl.Charge("foo", 50_000_000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := time.Since(begin); d > 100*time.Millisecond {
+		t.Errorf("expected charge to be independent of the cost, took %v", d)
+	}
+	// every slot is charged 5M times
+	if n := rl.RetryAfter("foo"); n != 5_000_000 {
+		t.Errorf("expected retry after 5000000s, got %d", n)
+	}
+	cb, _ := rl.store.Get("foo")
+	for i := 1; i < cb.Cap(); i++ {
+		if cb.nth(i).Before(cb.nth(i - 1)) {
+			t.Fatalf("slots not in time order at %d: %v < %v", i, cb.nth(i), cb.nth(i-1))
+		}
+	}
+}
+
+func TestKeyedLimiterChargeConcurrent(t *testing.T) {
+	rl, err := NewClientRateLimiterWithOptions(50, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+	rl.Allow(t.Context(), "foo")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if rl.Allow(t.Context(), "foo") {
+					rl.Charge("foo", 3)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	cb, _ := rl.store.Get("foo")
+	for i := 1; i < cb.Cap(); i++ {
+		if cb.nth(i).Before(cb.nth(i - 1)) {
+			t.Fatalf("slots not in time order at %d: %v < %v", i, cb.nth(i), cb.nth(i-1))
+		}
+	}
+}
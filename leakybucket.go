@@ -0,0 +1,269 @@
+package circularbuffer
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// LeakyBucket shapes the requests of each key to a constant rate
+// instead of rejecting bursts. Requests enter a bounded queue per key
+// and leave it one by one at the configured rate. Requests, that do not
+// fit into the queue, are rejected.
+//
+// Allow only checks and reserves a place in the queue and returns
+// immediately, such that LeakyBucket can be used as RateLimiter, that
+// allows the sustained rate plus depth requests in bursts. Wait blocks
+// until the request leaves the bucket, such that the caller sends
+// requests at a constant rate.
+type LeakyBucket struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	interval time.Duration
+	depth    int
+	conf     *config
+	closed   bool
+	quitCH   chan struct{}
+}
+
+type bucket struct {
+	// last is the time the newest request leaves the bucket.
+	last  time.Time
+	depth int
+}
+
+// NewLeakyBucket returns a LeakyBucket, which releases rate requests
+// per time.Duration d per key and queues at most depth requests per
+// key. WithClock, WithHooks and WithCleanInterval are supported. It
+// returns an *ArgumentError if an argument or option is invalid.
+func NewLeakyBucket(rate int, d time.Duration, depth int, opts ...Option) (*LeakyBucket, error) {
+	if depth < 0 {
+		return nil, &ArgumentError{Name: "depth", Value: depth}
+	}
+	c, err := newConfig(rate, d, opts)
+	if err != nil {
+		return nil, err
+	}
+	lb := &LeakyBucket{
+		buckets:  make(map[string]*bucket),
+		interval: max(d/time.Duration(rate), 1),
+		depth:    depth,
+		conf:     c,
+		quitCH:   make(chan struct{}),
+	}
+	go lb.startCleanerDaemon(c.cleanInterval)
+	return lb, nil
+}
+
+// queued returns the number of requests of b, that did not leave the
+// bucket at now. The request leaving at now is not queued.
+func (lb *LeakyBucket) queued(b *bucket, now time.Time) int {
+	if b == nil || !b.last.After(now) {
+		return 0
+	}
+	return int((b.last.Sub(now) + lb.interval - 1) / lb.interval)
+}
+
+// reserve enqueues n requests of s and returns the time the last of
+// them leaves the bucket. It returns false if the queue of s is full.
+func (lb *LeakyBucket) reserve(s string, n int) (time.Time, bool) {
+	now := lb.conf.clock.Now()
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b, ok := lb.buckets[s]
+	if !ok {
+		b = &bucket{depth: lb.depth}
+	}
+	at := now
+	if !b.last.IsZero() && b.last.Add(lb.interval).After(at) {
+		at = b.last.Add(lb.interval)
+	}
+	at = at.Add(time.Duration(n-1) * lb.interval)
+	if lb.queued(&bucket{last: at}, now) > b.depth {
+		return time.Time{}, false
+	}
+	b.last = at
+	lb.buckets[s] = b
+	return at, true
+}
+
+// Allow returns true and enqueues the request of s, if the queue of s
+// is not full, without waiting for the request to leave the bucket. A
+// request with a cost attached by ContextWithCost takes as many
+// places in the queue. If ctx is done, Allow returns false without
+// counting the request.
+func (lb *LeakyBucket) Allow(ctx context.Context, s string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	s = keyOf(ctx, s)
+	_, allowed := lb.reserve(s, CostFromContext(ctx))
+	if allowed {
+		lb.conf.hooks.allow(s)
+	} else {
+		lb.conf.hooks.reject(s)
+	}
+	recordDecision(ctx, lb, s, allowed)
+	return allowed
+}
+
+// Wait enqueues the request of s and blocks until it leaves the
+// bucket. It returns ErrQueueFull, if the queue of s is full, the
+// error of ctx, if ctx is done before, and ErrClosed, if the
+// LeakyBucket is closed. A request canceled while waiting keeps its
+// place in the queue. The delay is computed by the Clock of the
+// LeakyBucket, but waited for in wall time.
+func (lb *LeakyBucket) Wait(ctx context.Context, s string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lb.mu.Lock()
+	closed := lb.closed
+	lb.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	s = keyOf(ctx, s)
+	at, ok := lb.reserve(s, CostFromContext(ctx))
+	if !ok {
+		lb.conf.hooks.reject(s)
+		return ErrQueueFull
+	}
+	lb.conf.hooks.allow(s)
+	d := at.Sub(lb.conf.clock.Now())
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-lb.quitCH:
+		return ErrClosed
+	}
+}
+
+// Oldest returns the time the next queued request of s leaves the
+// bucket or the zero time, if the queue of s is empty.
+func (lb *LeakyBucket) Oldest(s string) time.Time {
+	now := lb.conf.clock.Now()
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b := lb.buckets[s]
+	n := lb.queued(b, now)
+	if n == 0 {
+		return time.Time{}
+	}
+	return b.last.Add(-time.Duration(n-1) * lb.interval)
+}
+
+// Delta returns the duration until the queue of s is empty.
+func (lb *LeakyBucket) Delta(s string) time.Duration {
+	now := lb.conf.clock.Now()
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if b, ok := lb.buckets[s]; ok && b.last.After(now) {
+		return b.last.Sub(now)
+	}
+	return 0
+}
+
+// Remaining returns the number of free places in the queue of s.
+func (lb *LeakyBucket) Remaining(s string) int {
+	now := lb.conf.clock.Now()
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b, ok := lb.buckets[s]
+	if !ok {
+		return lb.depth + 1
+	}
+	// the next request leaves at now and does not need a place in
+	// the queue
+	if !b.last.Add(lb.interval).After(now) {
+		return b.depth + 1
+	}
+	return max(b.depth-lb.queued(b, now), 0)
+}
+
+// RetryAfter returns how many seconds one should wait until the queue
+// of s has a free place.
+func (lb *LeakyBucket) RetryAfter(s string) int {
+	if lb.Remaining(s) > 0 {
+		return 0
+	}
+	next := lb.Oldest(s)
+	if next.IsZero() {
+		return 0
+	}
+	return int(math.Ceil(next.Sub(lb.conf.clock.Now()).Seconds()))
+}
+
+// Resize changes the depth of the queue of s to n, until the queue of
+// s is empty and removed. Requests already queued are kept.
+func (lb *LeakyBucket) Resize(s string, n int) error {
+	if n < 0 {
+		return &ArgumentError{Name: "depth", Value: n}
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b, ok := lb.buckets[s]
+	if !ok {
+		b = &bucket{}
+		lb.buckets[s] = b
+	}
+	b.depth = n
+	return nil
+}
+
+// Reset empties the queue of s. Requests blocked in Wait are not
+// released early.
+func (lb *LeakyBucket) Reset(s string) {
+	lb.mu.Lock()
+	delete(lb.buckets, s)
+	lb.mu.Unlock()
+}
+
+// DeleteOld removes the keys with an empty queue.
+func (lb *LeakyBucket) DeleteOld() {
+	now := lb.conf.clock.Now()
+	var evicted []string
+	lb.mu.Lock()
+	for k, b := range lb.buckets {
+		if !b.last.Add(lb.interval).After(now) {
+			delete(lb.buckets, k)
+			evicted = append(evicted, k)
+		}
+	}
+	lb.mu.Unlock()
+	for _, k := range evicted {
+		lb.conf.hooks.evict(k)
+	}
+}
+
+// Close stops the cleanup goroutine and releases all requests blocked
+// in Wait with ErrClosed.
+func (lb *LeakyBucket) Close() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.closed {
+		return
+	}
+	lb.closed = true
+	close(lb.quitCH)
+}
+
+func (lb *LeakyBucket) startCleanerDaemon(d time.Duration) {
+	for {
+		select {
+		case <-lb.quitCH:
+			return
+		case <-time.After(d):
+			lb.DeleteOld()
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package circularbuffer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeakyBucketAllow(t *testing.T) {
+	clock := newFakeClock()
+	lb, err := NewLeakyBucket(10, time.Second, 3, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var rl RateLimiter = lb
+	defer rl.Close()
+
+	if n := lb.Remaining("foo"); n != 4 {
+		t.Errorf("expected 4 remaining, got %d", n)
+	}
+	// one request leaves immediately, 3 are queued
+	for i := 0; i < 4; i++ {
+		if !lb.Allow(t.Context(), "foo") {
+			t.Fatalf("request %d should not be rate limitted", i)
+		}
+	}
+	if lb.Allow(t.Context(), "foo") {
+		t.Errorf("request should be rate limitted, if the queue is full")
+	}
+	if n := lb.Remaining("foo"); n != 0 {
+		t.Errorf("expected 0 remaining, got %d", n)
+	}
+	if d := lb.Delta("foo"); d != 300*time.Millisecond {
+		t.Errorf("expected queue to drain in 300ms, got %v", d)
+	}
+	if next := lb.Oldest("foo"); !next.Equal(clock.Now().Add(100 * time.Millisecond)) {
+		t.Errorf("expected next request to leave after 100ms, got %v", next.Sub(clock.Now()))
+	}
+	if n := lb.RetryAfter("foo"); n != 1 {
+		t.Errorf("expected retry after 1s, got %d", n)
+	}
+	if !lb.Allow(t.Context(), "bar") {
+		t.Errorf("other key should not be rate limitted")
+	}
+
+	// one request leaves every 100ms
+	clock.Advance(100 * time.Millisecond)
+	if n := lb.Remaining("foo"); n != 1 {
+		t.Errorf("expected 1 remaining, got %d", n)
+	}
+	if !lb.Allow(t.Context(), "foo") {
+		t.Errorf("request should not be rate limitted after a request left")
+	}
+	if lb.Allow(t.Context(), "foo") {
+		t.Errorf("request should be rate limitted, if the queue is full")
+	}
+
+	clock.Advance(time.Second)
+	if n := lb.Remaining("foo"); n != 4 {
+		t.Errorf("expected 4 remaining after the queue drained, got %d", n)
+	}
+	lb.DeleteOld()
+	lb.mu.Lock()
+	n := len(lb.buckets)
+	lb.mu.Unlock()
+	if n != 0 {
+		t.Errorf("expected drained buckets to be removed, got %d", n)
+	}
+}
+
+func TestLeakyBucketEvictHook(t *testing.T) {
+	clock := newFakeClock()
+	var lb *LeakyBucket
+	var remaining []int
+	lb, err := NewLeakyBucket(10, time.Second, 1, WithClock(clock),
+		WithHooks(Hooks{OnEvict: func(s string) { remaining = append(remaining, lb.Remaining(s)) }}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lb.Close()
+
+	lb.Allow(t.Context(), "foo")
+	clock.Advance(time.Second)
+	lb.DeleteOld()
+	if len(remaining) != 1 || remaining[0] != 2 {
+		t.Errorf("expected OnEvict to see 2 remaining, got %v", remaining)
+	}
+}
+
+func TestLeakyBucketWait(t *testing.T) {
+	lb, err := NewLeakyBucket(50, time.Second, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lb.Close()
+
+	var mu sync.Mutex
+	var released []time.Duration
+	var full int
+	begin := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := lb.Wait(t.Context(), "foo")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, ErrQueueFull):
+				full++
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			default:
+				released = append(released, time.Since(begin))
+			}
+		}()
+	}
+	wg.Wait()
+	if full != 1 || len(released) != 3 {
+		t.Fatalf("expected 3 released and 1 rejected request, got %d and %d", len(released), full)
+	}
+	if d := max(released[0], released[1], released[2]); d < 40*time.Millisecond {
+		t.Errorf("expected the last request to be released after 40ms, got %v", d)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Millisecond)
+	defer cancel()
+	lb.Wait(t.Context(), "bar")
+	if err := lb.Wait(ctx, "bar"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	lb.Close()
+	if err := lb.Wait(t.Context(), "baz"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestLeakyBucketResize(t *testing.T) {
+	clock := newFakeClock()
+	lb, err := NewLeakyBucket(1, time.Second, 0, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lb.Close()
+
+	if !lb.Allow(t.Context(), "foo") || lb.Allow(t.Context(), "foo") {
+		t.Errorf("depth 0 should only allow the request leaving immediately")
+	}
+	if err := lb.Resize("foo", 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !lb.Allow(t.Context(), "foo") {
+		t.Errorf("request should be queued after resize")
+	}
+	if err := lb.Resize("foo", -1); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	lb.Reset("foo")
+	if n := lb.Remaining("foo"); n != 1 {
+		t.Errorf("expected 1 remaining after reset, got %d", n)
+	}
+
+	if _, err := NewLeakyBucket(1, time.Second, -1); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	if _, err := NewLeakyBucket(0, time.Second, 1); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+}
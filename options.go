@@ -0,0 +1,287 @@
+package circularbuffer
+
+import (
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Clock returns the current time. It can be replaced by WithClock to
+// run a rate limiter on a virtual time, for example in tests or
+// simulations.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Hooks are called with the key on decisions of a rate limiter. Nil
+// functions are skipped. Hooks are called synchronously and must not
+// block or call back into the rate limiter, except for OnEvict of a
+// KeyedLimiter or LeakyBucket, which is called after their locks are
+// released and may read the state of the rate limiter.
+type Hooks struct {
+	// OnAllow is called if a request is allowed.
+	OnAllow func(key string)
+	// OnReject is called if a request is rate limited.
+	OnReject func(key string)
+	// OnEvict is called if the state of a key was removed.
+	OnEvict func(key string)
+}
+
+func (h *Hooks) allow(key string) {
+	if h.OnAllow != nil {
+		h.OnAllow(key)
+	}
+}
+
+func (h *Hooks) reject(key string) {
+	if h.OnReject != nil {
+		h.OnReject(key)
+	}
+}
+
+func (h *Hooks) evict(key string) {
+	if h.OnEvict != nil {
+		h.OnEvict(key)
+	}
+}
+
+// Algorithm selects how a rate limiter decides to allow a request.
+type Algorithm int
+
+const (
+	// SlidingWindowLog stores the time of each of the last maxHits
+	// requests and allows a request if the oldest one is older
+	// than the time window. This is the default.
+	SlidingWindowLog Algorithm = iota
+	// Smoothed is SlidingWindowLog, that additionally enforces a
+	// minimum interval of timeWindow/maxHits between requests, such
+	// that requests are spread evenly over the time window instead
+	// of arriving in spikes. The interval can be set by
+	// WithMinInterval and early requests can be delayed instead of
+	// rejected by WithMaxDelay.
+	Smoothed
+)
+
+// algorithms are all supported Algorithms.
+var algorithms = []Algorithm{SlidingWindowLog, Smoothed}
+
+func (a Algorithm) String() string {
+	switch a {
+	case SlidingWindowLog:
+		return "SlidingWindowLog"
+	case Smoothed:
+		return "Smoothed"
+	}
+	return "Algorithm(" + strconv.Itoa(int(a)) + ")"
+}
+
+// Option configures a CircularBuffer or ClientRateLimiter created by
+// NewCircularBufferWithOptions or NewClientRateLimiterWithOptions.
+// Options that do not apply to the created type are ignored.
+type Option func(*config)
+
+type config struct {
+	maxHits       int
+	timeWindow    time.Duration
+	cleanInterval time.Duration
+	maxKeys       int
+	clock         Clock
+	hooks         Hooks
+	algorithm     Algorithm
+	banDuration   time.Duration
+	maxBan        time.Duration
+	quotaStore    QuotaStore
+	burst         int
+	minInterval   time.Duration
+	maxDelay      time.Duration
+	store         any // Store[K] of the created KeyedLimiter
+}
+
+// WithCleanInterval sets the interval of the cleanup goroutine of a
+// ClientRateLimiter, which removes unused clients. It defaults to the
+// time window of the rate limit.
+func WithCleanInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.cleanInterval = d
+	}
+}
+
+// WithClock sets the Clock used to get the time of a request. It
+// defaults to time.Now.
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+// WithMaxKeys limits the number of clients tracked by a
+// ClientRateLimiter. Requests of new clients are rate limited, if n
+// clients are tracked already. 0, the default, means unlimited.
+func WithMaxKeys(n int) Option {
+	return func(c *config) {
+		c.maxKeys = n
+	}
+}
+
+// WithHooks sets the Hooks called on decisions of the rate limiter.
+func WithHooks(h Hooks) Option {
+	return func(c *config) {
+		c.hooks = h
+	}
+}
+
+// WithAlgorithm sets the Algorithm of the rate limiter. It defaults
+// to SlidingWindowLog.
+func WithAlgorithm(a Algorithm) Option {
+	return func(c *config) {
+		c.algorithm = a
+	}
+}
+
+// WithBanDuration sets the duration of the first ban of a
+// PenaltyLimiter and the maximum duration of escalated bans. It
+// defaults to the period of the PenaltyLimiter and 24 hours.
+func WithBanDuration(d, maxBan time.Duration) Option {
+	return func(c *config) {
+		c.banDuration = d
+		c.maxBan = maxBan
+	}
+}
+
+// WithBurst allows burst requests on top of maxHits. An idle client
+// can send maxHits+burst requests at once, but every request is
+// scheduled timeWindow/maxHits after the previous one, such that the
+// sustained rate stays maxHits per time window and a drained client
+// gets one request per timeWindow/maxHits like from a token bucket.
+// The buffer stores the scheduled times of the requests, which is what
+// Oldest, Current and Delta return.
+// It can not be combined with the Smoothed algorithm or
+// WithMinInterval. It defaults to 0, which is the plain sliding
+// window.
+func WithBurst(burst int) Option {
+	return func(c *config) {
+		c.burst = burst
+	}
+}
+
+// WithMinInterval sets the minimum interval between two requests of a
+// CircularBuffer or of a key of a ClientRateLimiter. Requests within
+// the interval are rejected or delayed, see WithMaxDelay. It defaults
+// to timeWindow/maxHits for the Smoothed algorithm and to 0, no
+// minimum interval, otherwise.
+func WithMinInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.minInterval = d
+	}
+}
+
+// WithMaxDelay lets Allow delay requests, that arrive earlier than the
+// minimum interval after the previous request, by up to d instead of
+// rejecting them. A delayed request reserves its time, such that
+// concurrent requests queue up behind it, and Allow returns true when
+// the time is reached. The delay is computed by the Clock, see
+// WithClock, but waited for in wall time. It defaults to 0, which
+// rejects early requests.
+func WithMaxDelay(d time.Duration) Option {
+	return func(c *config) {
+		c.maxDelay = d
+	}
+}
+
+// WithStore sets the Store of the buffers of the keys of a
+// KeyedLimiter or ClientRateLimiter. K has to be the key type of the
+// created limiter, otherwise the constructor returns an
+// *ArgumentError. It defaults to a new MapStore.
+func WithStore[K comparable](s Store[K]) Option {
+	return func(c *config) {
+		c.store = s
+	}
+}
+
+func defaultConfig(maxHits int, d time.Duration) *config {
+	return &config{
+		maxHits:       maxHits,
+		timeWindow:    d,
+		cleanInterval: d,
+		clock:         systemClock{},
+		algorithm:     SlidingWindowLog,
+		banDuration:   d,
+		maxBan:        max(d, 24*time.Hour),
+	}
+}
+
+func newConfig(maxHits int, d time.Duration, opts []Option) (*config, error) {
+	c := defaultConfig(maxHits, d)
+	for _, o := range opts {
+		o(c)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *config) validate() error {
+	switch {
+	case c.maxHits <= 0:
+		return &ArgumentError{Name: "maxHits", Value: c.maxHits}
+	case c.timeWindow <= 0:
+		return &ArgumentError{Name: "timeWindow", Value: c.timeWindow}
+	case c.cleanInterval <= 0:
+		return &ArgumentError{Name: "cleanInterval", Value: c.cleanInterval}
+	case c.burst < 0:
+		return &ArgumentError{Name: "burst", Value: c.burst}
+	case c.burst > 0 && (c.algorithm == Smoothed || c.minInterval > 0):
+		return &ArgumentError{Name: "burst", Value: c.burst}
+	case c.maxKeys < 0:
+		return &ArgumentError{Name: "maxKeys", Value: c.maxKeys}
+	case c.clock == nil:
+		return &ArgumentError{Name: "clock", Value: c.clock}
+	case !slices.Contains(algorithms, c.algorithm):
+		return &ArgumentError{Name: "algorithm", Value: c.algorithm}
+	case c.minInterval < 0:
+		return &ArgumentError{Name: "minInterval", Value: c.minInterval}
+	case c.maxDelay < 0:
+		return &ArgumentError{Name: "maxDelay", Value: c.maxDelay}
+	}
+	return nil
+}
+
+// validateUnsmoothed returns an *ArgumentError, if requests are spaced
+// by a minimum interval, which is not supported by limiters consuming
+// hits of several requests or levels at once.
+func (c *config) validateUnsmoothed() error {
+	switch {
+	case c.algorithm == Smoothed:
+		return &ArgumentError{Name: "algorithm", Value: c.algorithm}
+	case c.minInterval > 0:
+		return &ArgumentError{Name: "minInterval", Value: c.minInterval}
+	}
+	return nil
+}
+
+// validateBan validates the options of a PenaltyLimiter, which are
+// ignored by the other constructors.
+func (c *config) validateBan() error {
+	switch {
+	case c.banDuration <= 0:
+		return &ArgumentError{Name: "banDuration", Value: c.banDuration}
+	case c.maxBan < c.banDuration:
+		return &ArgumentError{Name: "maxBanDuration", Value: c.maxBan}
+	}
+	return nil
+}
+
+// slotWindow returns the time window of the slots of a buffer with
+// maxHits per window plus burst, which is window/maxHits with a burst,
+// see WithBurst.
+func slotWindow(maxHits, burst int, window time.Duration) time.Duration {
+	if burst == 0 {
+		return window
+	}
+	return window / time.Duration(maxHits)
+}
@@ -0,0 +1,414 @@
+package circularbuffer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewWithOptionsValidation(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		maxHits int
+		d       time.Duration
+		opts    []Option
+		arg     string
+	}{
+		{name: "valid", maxHits: 1, d: time.Second},
+		{name: "zero maxHits", maxHits: 0, d: time.Second, arg: "maxHits"},
+		{name: "negative maxHits", maxHits: -1, d: time.Second, arg: "maxHits"},
+		{name: "zero window", maxHits: 1, d: 0, arg: "timeWindow"},
+		{name: "negative window", maxHits: 1, d: -time.Second, arg: "timeWindow"},
+		{name: "zero clean interval", maxHits: 1, d: time.Second, opts: []Option{WithCleanInterval(0)}, arg: "cleanInterval"},
+		{name: "negative burst", maxHits: 1, d: time.Second, opts: []Option{WithBurst(-1)}, arg: "burst"},
+		{name: "negative min interval", maxHits: 1, d: time.Second, opts: []Option{WithMinInterval(-1)}, arg: "minInterval"},
+		{name: "negative max delay", maxHits: 1, d: time.Second, opts: []Option{WithMaxDelay(-1)}, arg: "maxDelay"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			check := func(err error) {
+				t.Helper()
+				if tt.arg == "" {
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					return
+				}
+				if !errors.Is(err, ErrInvalidArgument) {
+					t.Fatalf("expected ErrInvalidArgument, got %v", err)
+				}
+				var argErr *ArgumentError
+				if !errors.As(err, &argErr) || argErr.Name != tt.arg {
+					t.Fatalf("expected ArgumentError for %s, got %v", tt.arg, err)
+				}
+			}
+
+			cb, err := NewCircularBufferWithOptions(tt.maxHits, tt.d, tt.opts...)
+			check(err)
+			if err == nil && !cb.Free() {
+				t.Errorf("new buffer should be free")
+			}
+
+			rl, err := NewClientRateLimiterWithOptions(tt.maxHits, tt.d, tt.opts...)
+			check(err)
+			if err == nil {
+				rl.Close()
+			}
+		})
+	}
+}
+
+func TestResizeErrors(t *testing.T) {
+	cb := NewCircularBuffer(2, time.Second)
+	if err := cb.Resize("", 0); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	if cb.Cap() != 2 {
+		t.Errorf("invalid resize should not change the buffer, cap is %d", cb.Cap())
+	}
+	if err := cb.Resize("", 4); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	rl := newClientRateLimiter(2, time.Second)
+	defer rl.Close()
+	if err := rl.Resize("foo", 4); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	rl.Allow(t.Context(), "foo")
+	if err := rl.Resize("foo", -1); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	if err := rl.Resize("foo", 4); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestWithClock(t *testing.T) {
+	clock := newFakeClock()
+	window := time.Minute
+	cb, err := NewCircularBufferWithOptions(2, window, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rl, err := NewClientRateLimiterWithOptions(2, window, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	for _, l := range []RateLimiter{cb, rl} {
+		for i := 0; i < 2; i++ {
+			if !l.Allow(t.Context(), "foo") {
+				t.Errorf("%T: foo should not be rate limitted", l)
+			}
+		}
+		if l.Allow(t.Context(), "foo") {
+			t.Errorf("%T: foo should be rate limitted", l)
+		}
+		if n := l.RetryAfter("foo"); n != 60 {
+			t.Errorf("%T: expected retry after 60s, got %d", l, n)
+		}
+	}
+
+	clock.Advance(window + time.Nanosecond)
+	for _, l := range []RateLimiter{cb, rl} {
+		if !l.Allow(t.Context(), "foo") {
+			t.Errorf("%T: foo should not be rate limitted after the window", l)
+		}
+	}
+}
+
+func TestWithHooks(t *testing.T) {
+	clock := newFakeClock()
+	var allowed, rejected, evicted []string
+	hooks := Hooks{
+		OnAllow:  func(key string) { allowed = append(allowed, key) },
+		OnReject: func(key string) { rejected = append(rejected, key) },
+		OnEvict:  func(key string) { evicted = append(evicted, key) },
+	}
+	rl, err := NewClientRateLimiterWithOptions(1, time.Second, WithClock(clock), WithHooks(hooks), WithCleanInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	rl.Allow(t.Context(), "foo")
+	rl.Allow(t.Context(), "foo")
+	rl.Allow(t.Context(), "bar")
+	clock.Advance(2 * time.Second)
+	rl.DeleteOld()
+
+	if fmt.Sprint(allowed) != "[foo bar]" {
+		t.Errorf("unexpected allowed: %v", allowed)
+	}
+	if fmt.Sprint(rejected) != "[foo]" {
+		t.Errorf("unexpected rejected: %v", rejected)
+	}
+	sort.Strings(evicted)
+	if fmt.Sprint(evicted) != "[bar foo]" {
+		t.Errorf("unexpected evicted: %v", evicted)
+	}
+}
+
+func TestWithMaxKeys(t *testing.T) {
+	rl, err := NewClientRateLimiterWithOptions(10, time.Second, WithMaxKeys(2))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	if !rl.Allow(t.Context(), "foo") || !rl.Allow(t.Context(), "bar") {
+		t.Errorf("first 2 keys should not be rate limitted")
+	}
+	if rl.Allow(t.Context(), "baz") {
+		t.Errorf("3rd key should be rate limitted")
+	}
+	if !rl.Allow(t.Context(), "foo") {
+		t.Errorf("known key should not be rate limitted")
+	}
+}
+
+func TestWithAlgorithm(t *testing.T) {
+	for _, a := range []Algorithm{SlidingWindowLog, Smoothed} {
+		rl, err := NewClientRateLimiterWithOptions(1, time.Second, WithAlgorithm(a))
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", a, err)
+		}
+		rl.Close()
+	}
+	if _, err := NewClientRateLimiterWithOptions(1, time.Second, WithAlgorithm(Algorithm(-1))); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+func TestWithBurst(t *testing.T) {
+	clock := newFakeClock()
+	cb, err := NewCircularBufferWithOptions(10, time.Second, WithClock(clock), WithBurst(40))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rl, err := NewClientRateLimiterWithOptions(10, time.Second, WithClock(clock), WithBurst(40))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	if n := rl.Remaining("foo"); n != 50 {
+		t.Errorf("expected 50 remaining of unknown key, got %d", n)
+	}
+	for i := 0; i < 50; i++ {
+		for _, l := range []RateLimiter{cb, rl} {
+			if !l.Allow(t.Context(), "foo") {
+				t.Fatalf("%T: request %d of the burst should not be rate limitted", l, i)
+			}
+		}
+		clock.Advance(time.Millisecond)
+	}
+	for _, l := range []RateLimiter{cb, rl} {
+		if l.Allow(t.Context(), "foo") {
+			t.Errorf("%T: request after the burst should be rate limitted", l)
+		}
+		if n := l.Remaining("foo"); n != 0 {
+			t.Errorf("%T: expected 0 remaining after the burst, got %d", l, n)
+		}
+		// the requests are scheduled 100ms apart
+		if d := l.Delta("foo"); d != 4900*time.Millisecond {
+			t.Errorf("%T: expected delta 4.9s, got %v", l, d)
+		}
+	}
+	for _, cur := range []time.Time{cb.Current("foo"), rl.Current("foo")} {
+		if !cur.After(clock.Now()) {
+			t.Errorf("expected the newest request to be scheduled in the future, got %v", cur)
+		}
+	}
+	// the first request is scheduled at 0, the next one is allowed
+	// 100ms later
+	if d := cb.retryAfter(); d != 50*time.Millisecond {
+		t.Errorf("expected retry after 50ms, got %v", d)
+	}
+
+	// a drained client gets the sustained rate of 10/s
+	clock.Advance(50 * time.Millisecond)
+	for i := 0; i < 40; i++ {
+		for _, l := range []RateLimiter{cb, rl} {
+			if !l.Allow(t.Context(), "foo") {
+				t.Fatalf("%T: request %d at the sustained rate should not be rate limitted", l, i)
+			}
+			if l.Allow(t.Context(), "foo") {
+				t.Fatalf("%T: request %d above the sustained rate should be rate limitted", l, i)
+			}
+		}
+		if d := cb.retryAfter(); d != 100*time.Millisecond {
+			t.Fatalf("expected retry after 100ms, got %v", d)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+
+	// an idle client gets the burst again
+	clock.Advance(5 * time.Second)
+	for _, l := range []RateLimiter{cb, rl} {
+		if n := l.Remaining("foo"); n != 50 {
+			t.Errorf("%T: expected 50 remaining after idling, got %d", l, n)
+		}
+		if !l.Allow(ContextWithCost(t.Context(), 50), "foo") {
+			t.Errorf("%T: burst after idling should not be rate limitted", l)
+		}
+	}
+
+	if err := cb.Reconfigure("", 20, time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := cb.Cap(); n != 60 {
+		t.Errorf("expected capacity 60 after reconfigure, got %d", n)
+	}
+	if d := cb.timeWindow(); d != 50*time.Millisecond {
+		t.Errorf("expected slot window 50ms after reconfigure, got %v", d)
+	}
+
+	for _, opt := range []Option{WithAlgorithm(Smoothed), WithMinInterval(time.Second)} {
+		if _, err := NewCircularBufferWithOptions(10, time.Second, WithBurst(1), opt); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("expected ErrInvalidArgument for burst with smoothing, got %v", err)
+		}
+	}
+}
+
+func TestWithBurstCharge(t *testing.T) {
+	clock := newFakeClock()
+	rl, err := NewClientRateLimiterWithOptions(10, time.Second, WithClock(clock), WithBurst(10))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	rl.Allow(t.Context(), "foo")
+	if err := rl.Charge("foo", 100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 101 requests are scheduled 100ms apart, the oldest of the
+	// newest 20 at 8.1s
+	if n := rl.RetryAfter("foo"); n != 9 {
+		t.Errorf("expected retry after 9s, got %d", n)
+	}
+	clock.Advance(8200 * time.Millisecond)
+	if !rl.Allow(t.Context(), "foo") || rl.Allow(t.Context(), "foo") {
+		t.Errorf("expected one request after the debt")
+	}
+}
+
+func TestSmoothed(t *testing.T) {
+	clock := newFakeClock()
+	cb, err := NewCircularBufferWithOptions(10, time.Second, WithClock(clock), WithAlgorithm(Smoothed))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rl, err := NewClientRateLimiterWithOptions(10, time.Second, WithClock(clock), WithAlgorithm(Smoothed))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	for _, l := range []RateLimiter{cb, rl} {
+		if !l.Allow(t.Context(), "foo") {
+			t.Errorf("%T: first request should not be rate limitted", l)
+		}
+		if l.Allow(t.Context(), "foo") {
+			t.Errorf("%T: request within the minimum interval should be rate limitted", l)
+		}
+		if n := l.RetryAfter("foo"); n != 1 {
+			t.Errorf("%T: expected retry after 1s, got %d", l, n)
+		}
+	}
+	clock.Advance(99 * time.Millisecond)
+	for _, l := range []RateLimiter{cb, rl} {
+		if l.Allow(t.Context(), "foo") {
+			t.Errorf("%T: request before the minimum interval should be rate limitted", l)
+		}
+	}
+	clock.Advance(time.Millisecond)
+	for _, l := range []RateLimiter{cb, rl} {
+		if !l.Allow(t.Context(), "foo") {
+			t.Errorf("%T: request after the minimum interval should not be rate limitted", l)
+		}
+	}
+
+	cb, err = NewCircularBufferWithOptions(10, time.Second, WithClock(clock), WithMinInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if !cb.Allow(t.Context(), "") {
+			t.Errorf("request %d should not be rate limitted", i)
+		}
+		clock.Advance(10 * time.Millisecond)
+	}
+	if cb.Allow(t.Context(), "") {
+		t.Errorf("request above maxHits should be rate limitted")
+	}
+}
+
+func TestWithMaxDelay(t *testing.T) {
+	clock := newFakeClock()
+	rl, err := NewClientRateLimiterWithOptions(10, time.Second, WithClock(clock), WithMinInterval(20*time.Millisecond), WithMaxDelay(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	// the clock does not advance, so the requests are due at 0, 20
+	// and 40ms and later requests exceed the maximum delay
+	begin := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var allowed int
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rl.Allow(t.Context(), "foo") {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 3 {
+		t.Errorf("expected 3 allowed requests, got %d", allowed)
+	}
+	if d := time.Since(begin); d < 40*time.Millisecond {
+		t.Errorf("expected requests to be delayed by 40ms, got %v", d)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Millisecond)
+	defer cancel()
+	// due at 60ms, 30ms after now
+	clock.Advance(30 * time.Millisecond)
+	if rl.Allow(ctx, "foo") {
+		t.Errorf("request canceled while delayed should be rate limitted")
+	}
+}
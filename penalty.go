@@ -0,0 +1,222 @@
+package circularbuffer
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PenaltyLimiter wraps a RateLimiter and bans keys, that are rate
+// limited repeatedly, fail2ban style. If a key was rejected by the
+// wrapped RateLimiter rejections times within period, it is banned.
+// The first ban lasts the configured ban duration, every further ban
+// doubles the duration up to the maximum ban duration. The escalation
+// is forgotten, if a key was not banned for the maximum ban duration.
+// This can be used to protect /login APIs from brute-force attacks.
+type PenaltyLimiter struct {
+	mu        sync.Mutex
+	limiter   RateLimiter
+	penalties map[string]*penalty
+	conf      *config
+	quitCH    chan struct{}
+}
+
+type penalty struct {
+	strikes *CircularBuffer
+	level   int
+	until   time.Time
+}
+
+// Ban is a banned key returned by PenaltyLimiter.Bans.
+type Ban struct {
+	Key   string
+	Until time.Time
+	// Level is the number of escalations, 1 for the first ban.
+	Level int
+}
+
+// NewPenaltyLimiter returns a PenaltyLimiter wrapping rl, which bans
+// keys after the given number of rejections within period. Use
+// WithBanDuration to configure the ban durations, WithClock and
+// WithCleanInterval are also supported. It returns an *ArgumentError
+// if an argument or option is invalid.
+func NewPenaltyLimiter(rl RateLimiter, rejections int, period time.Duration, opts ...Option) (*PenaltyLimiter, error) {
+	c, err := newConfig(rejections, period, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.validateBan(); err != nil {
+		return nil, err
+	}
+	pl := &PenaltyLimiter{
+		limiter:   rl,
+		penalties: make(map[string]*penalty),
+		conf:      c,
+		quitCH:    make(chan struct{}),
+	}
+	go pl.startCleanerDaemon(c.cleanInterval)
+	return pl, nil
+}
+
+// Allow returns false for banned keys and the decision of the wrapped
+// RateLimiter for all other keys. A rejection by the wrapped
+// RateLimiter is counted as strike and may ban the key.
+func (pl *PenaltyLimiter) Allow(ctx context.Context, s string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	s = keyOf(ctx, s)
+	allowed := pl.allow(ctx, s)
+	recordDecision(ctx, pl, s, allowed)
+	return allowed
+}
+
+func (pl *PenaltyLimiter) allow(ctx context.Context, s string) bool {
+	now := pl.conf.clock.Now()
+	if _, ok := pl.bannedUntil(s, now); ok {
+		return false
+	}
+	if pl.limiter.Allow(ctx, s) {
+		return true
+	}
+
+	pl.mu.Lock()
+	p, ok := pl.penalties[s]
+	if !ok {
+		p = &penalty{strikes: pl.conf.newCircularBuffer()}
+		pl.penalties[s] = p
+	}
+	p.strikes.Add(now)
+	if p.strikes.Len() >= pl.conf.maxHits {
+		pl.ban(p, now)
+	}
+	pl.mu.Unlock()
+	return false
+}
+
+// bannedUntil returns the end of the ban of s and true, if s is
+// banned at now.
+func (pl *PenaltyLimiter) bannedUntil(s string, now time.Time) (time.Time, bool) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if p, ok := pl.penalties[s]; ok && now.Before(p.until) {
+		return p.until, true
+	}
+	return time.Time{}, false
+}
+
+// ban needs to be called with mu held by caller
+func (pl *PenaltyLimiter) ban(p *penalty, now time.Time) {
+	if !p.until.IsZero() && now.Sub(p.until) > pl.conf.maxBan {
+		p.level = 0
+	}
+	p.level++
+	d := pl.conf.maxBan
+	if p.level < 63 && pl.conf.banDuration <= pl.conf.maxBan>>(p.level-1) {
+		d = pl.conf.banDuration << (p.level - 1)
+	}
+	p.until = now.Add(d)
+	p.strikes = pl.conf.newCircularBuffer()
+}
+
+// Bans returns the currently banned keys sorted by key.
+func (pl *PenaltyLimiter) Bans() []Ban {
+	now := pl.conf.clock.Now()
+	var bans []Ban
+	pl.mu.Lock()
+	for k, p := range pl.penalties {
+		if now.Before(p.until) {
+			bans = append(bans, Ban{Key: k, Until: p.until, Level: p.level})
+		}
+	}
+	pl.mu.Unlock()
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Key < bans[j].Key
+	})
+	return bans
+}
+
+// Lift removes the ban and all strikes of the key s and resets its
+// escalation. It returns false if s was not banned.
+func (pl *PenaltyLimiter) Lift(s string) bool {
+	now := pl.conf.clock.Now()
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	p, ok := pl.penalties[s]
+	delete(pl.penalties, s)
+	return ok && now.Before(p.until)
+}
+
+// RetryAfter returns how many seconds one should wait until the next
+// request is allowed, which is the remaining ban duration for banned
+// keys.
+func (pl *PenaltyLimiter) RetryAfter(s string) int {
+	now := pl.conf.clock.Now()
+	if until, ok := pl.bannedUntil(s, now); ok {
+		return int(math.Ceil(until.Sub(now).Seconds()))
+	}
+	return pl.limiter.RetryAfter(s)
+}
+
+// Remaining returns 0 for banned keys and the remaining requests of
+// the wrapped RateLimiter for all other keys.
+func (pl *PenaltyLimiter) Remaining(s string) int {
+	if _, ok := pl.bannedUntil(s, pl.conf.clock.Now()); ok {
+		return 0
+	}
+	return pl.limiter.Remaining(s)
+}
+
+// Oldest implements the RateLimiter interface
+func (pl *PenaltyLimiter) Oldest(s string) time.Time {
+	return pl.limiter.Oldest(s)
+}
+
+// Delta implements the RateLimiter interface
+func (pl *PenaltyLimiter) Delta(s string) time.Duration {
+	return pl.limiter.Delta(s)
+}
+
+// Resize implements the RateLimiter interface
+func (pl *PenaltyLimiter) Resize(s string, n int) error {
+	return pl.limiter.Resize(s, n)
+}
+
+// Reset lifts the ban of the key s and resets it in the wrapped
+// RateLimiter.
+func (pl *PenaltyLimiter) Reset(s string) {
+	pl.Lift(s)
+	pl.limiter.Reset(s)
+}
+
+// DeleteOld removes keys without ban, strikes and escalation.
+func (pl *PenaltyLimiter) DeleteOld() {
+	now := pl.conf.clock.Now()
+	pl.mu.Lock()
+	for k, p := range pl.penalties {
+		if now.Sub(p.until) > pl.conf.maxBan && !p.strikes.InUse() {
+			delete(pl.penalties, k)
+		}
+	}
+	pl.mu.Unlock()
+}
+
+// Close stops the cleanup goroutine and closes the wrapped
+// RateLimiter.
+func (pl *PenaltyLimiter) Close() {
+	close(pl.quitCH)
+	pl.limiter.Close()
+}
+
+func (pl *PenaltyLimiter) startCleanerDaemon(d time.Duration) {
+	for {
+		select {
+		case <-pl.quitCH:
+			return
+		case <-time.After(d):
+			pl.DeleteOld()
+		}
+	}
+}
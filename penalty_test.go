@@ -0,0 +1,147 @@
+package circularbuffer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPenaltyLimiterEscalation(t *testing.T) {
+	clock := newFakeClock()
+	rl, err := NewClientRateLimiterWithOptions(1, time.Second, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pl, err := NewPenaltyLimiter(rl, 3, time.Minute, WithClock(clock), WithBanDuration(time.Minute, 3*time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pl.Close()
+
+	offend := func() {
+		t.Helper()
+		if !pl.Allow(t.Context(), "foo") {
+			t.Fatalf("foo should not be rate limitted")
+		}
+		for i := 0; i < 3; i++ {
+			if pl.Allow(t.Context(), "foo") {
+				t.Fatalf("foo should be rate limitted")
+			}
+		}
+	}
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		offend()
+		bans := pl.Bans()
+		if len(bans) != 1 || bans[0].Key != "foo" {
+			t.Fatalf("foo should be banned, bans: %v", bans)
+		}
+		if d := bans[0].Until.Sub(clock.Now()); d != want {
+			t.Errorf("expected ban of %s, got %s", want, d)
+		}
+		if n := pl.RetryAfter("foo"); n != int(want.Seconds()) {
+			t.Errorf("expected retry after %s, got %ds", want, n)
+		}
+		if pl.Remaining("foo") != 0 {
+			t.Errorf("banned key should have no remaining requests")
+		}
+
+		clock.Advance(want - time.Second)
+		if pl.Allow(t.Context(), "foo") {
+			t.Errorf("foo should be banned")
+		}
+		clock.Advance(time.Second)
+	}
+
+	// escalation is forgotten after the maximum ban duration
+	clock.Advance(3*time.Minute + time.Second)
+	offend()
+	if d := pl.Bans()[0].Until.Sub(clock.Now()); d != time.Minute {
+		t.Errorf("expected reset ban of 1m, got %s", d)
+	}
+}
+
+func TestPenaltyLimiterStrikesExpire(t *testing.T) {
+	clock := newFakeClock()
+	rl, _ := NewClientRateLimiterWithOptions(1, time.Second, WithClock(clock))
+	pl, err := NewPenaltyLimiter(rl, 2, time.Minute, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pl.Close()
+
+	pl.Allow(t.Context(), "foo")
+	pl.Allow(t.Context(), "foo") // strike 1
+	clock.Advance(2 * time.Minute)
+	pl.Allow(t.Context(), "foo")
+	pl.Allow(t.Context(), "foo") // strike 1 again, the first expired
+	if bans := pl.Bans(); len(bans) != 0 {
+		t.Errorf("foo should not be banned: %v", bans)
+	}
+	pl.Allow(t.Context(), "foo") // strike 2
+	if bans := pl.Bans(); len(bans) != 1 {
+		t.Errorf("foo should be banned: %v", bans)
+	}
+}
+
+func TestPenaltyLimiterLift(t *testing.T) {
+	clock := newFakeClock()
+	rl, _ := NewClientRateLimiterWithOptions(1, time.Second, WithClock(clock))
+	pl, err := NewPenaltyLimiter(rl, 1, time.Minute, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pl.Close()
+
+	if pl.Lift("foo") {
+		t.Errorf("foo is not banned")
+	}
+	pl.Allow(t.Context(), "foo")
+	pl.Allow(t.Context(), "foo")
+	if !pl.Lift("foo") {
+		t.Errorf("foo should be banned")
+	}
+	if len(pl.Bans()) != 0 {
+		t.Errorf("ban should be lifted")
+	}
+	clock.Advance(time.Second + time.Nanosecond)
+	if !pl.Allow(t.Context(), "foo") {
+		t.Errorf("foo should not be rate limitted after lift")
+	}
+
+	clock.Advance(time.Hour)
+	pl.DeleteOld()
+	if len(pl.penalties) != 0 {
+		t.Errorf("expected penalties to be deleted, got %d", len(pl.penalties))
+	}
+}
+
+func TestPenaltyLimiterInvalidBanDuration(t *testing.T) {
+	rl := newClientRateLimiter(1, time.Second)
+	defer rl.Close()
+	if _, err := NewPenaltyLimiter(rl, 1, time.Minute, WithBanDuration(time.Hour, time.Minute)); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	other, err := NewClientRateLimiterWithOptions(1, time.Second, WithBanDuration(0, 0))
+	if err != nil {
+		t.Fatalf("ban duration should be ignored by other limiters: %v", err)
+	}
+	other.Close()
+}
+
+func TestPenaltyLimiterReset(t *testing.T) {
+	clock := newFakeClock()
+	rl, _ := NewClientRateLimiterWithOptions(1, time.Minute, WithClock(clock))
+	pl, err := NewPenaltyLimiter(rl, 1, time.Minute, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pl.Close()
+
+	pl.Allow(t.Context(), "foo")
+	pl.Allow(t.Context(), "foo")
+	pl.Reset("foo")
+	if !pl.Allow(t.Context(), "foo") {
+		t.Errorf("foo should not be rate limitted after reset")
+	}
+}
@@ -0,0 +1,155 @@
+package circularbuffer
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Priority is the priority class of a request. Higher values are more
+// important, 0 is the lowest priority.
+type Priority int
+
+// PriorityLimiter protects a backend from a maximum number of calls
+// like CircularBuffer, but reserves capacity for important requests.
+// Each Priority may only use capacity up to a configured fraction of
+// maxHits, such that during overload best-effort traffic is shed
+// first, while critical traffic can still use the reserved remainder.
+type PriorityLimiter struct {
+	mu        sync.Mutex
+	cb        *CircularBuffer
+	fractions []float64
+}
+
+// NewPriorityLimiter returns a PriorityLimiter with maxHits per
+// time.Duration d. fractions[p] is the fraction of maxHits, that
+// requests of Priority p may use. Fractions have to be in (0, 1] and
+// must not decrease with increasing priority, for example []float64{0.5,
+// 0.8, 1} lets priority 0 use 50%, priority 1 use 80% and priority 2
+// use all of the capacity. The Smoothed algorithm and WithMinInterval
+// are not supported and return an *ArgumentError.
+func NewPriorityLimiter(maxHits int, d time.Duration, fractions []float64, opts ...Option) (*PriorityLimiter, error) {
+	if len(fractions) == 0 {
+		return nil, &ArgumentError{Name: "fractions", Value: fractions}
+	}
+	for i, f := range fractions {
+		if f <= 0 || f > 1 || (i > 0 && f < fractions[i-1]) {
+			return nil, &ArgumentError{Name: "fractions", Value: fractions}
+		}
+	}
+	c, err := newConfig(maxHits, d, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.validateUnsmoothed(); err != nil {
+		return nil, err
+	}
+	return &PriorityLimiter{
+		cb:        c.newCircularBuffer(),
+		fractions: append([]float64(nil), fractions...),
+	}, nil
+}
+
+// limit returns the number of hits priority p may use. Priorities
+// above the configured ones use the highest fraction.
+func (pl *PriorityLimiter) limit(p Priority) int {
+	i := min(max(int(p), 0), len(pl.fractions)-1)
+	return max(1, int(math.Floor(pl.fractions[i]*float64(pl.cb.Cap()))))
+}
+
+// AllowPriority returns true if a request of priority p is allowed. A
+// request with a cost attached by ContextWithCost needs as many hits
+// within the limit of p. If ctx is done, AllowPriority returns false
+// without counting the request.
+func (pl *PriorityLimiter) AllowPriority(ctx context.Context, p Priority) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	cost := CostFromContext(ctx)
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.cb.Len()+cost > pl.limit(p) {
+		return false
+	}
+	return pl.cb.addN(pl.cb.clock.Now(), cost)
+}
+
+// RemainingPriority returns how many requests of priority p are
+// allowed until it will be rate limited.
+func (pl *PriorityLimiter) RemainingPriority(p Priority) int {
+	return max(0, pl.limit(p)-pl.cb.Len())
+}
+
+// RetryAfterPriority returns how many seconds one should wait until
+// the next request of priority p is allowed.
+func (pl *PriorityLimiter) RetryAfterPriority(p Priority) int {
+	l := pl.cb.Len()
+	limit := pl.limit(p)
+	if l < limit {
+		return 0
+	}
+	// the active hits are the newest l slots, the slot at
+	// Cap()-limit has to expire to get below the limit
+	next := pl.cb.nth(pl.cb.Cap() - limit).Add(pl.cb.timeWindow())
+	return int(math.Ceil(next.Sub(pl.cb.clock.Now()).Seconds()))
+}
+
+// Allow implements the RateLimiter interface and allows the request
+// with the priority attached by ContextWithPriority, which defaults
+// to the lowest priority.
+func (pl *PriorityLimiter) Allow(ctx context.Context, s string) bool {
+	p, _ := PriorityFromContext(ctx)
+	allowed := pl.AllowPriority(ctx, p)
+	if r := recorderFrom(ctx); r != nil {
+		r.record(Decision{
+			Allowed:    allowed,
+			Key:        keyOf(ctx, s),
+			Cost:       CostFromContext(ctx),
+			Remaining:  pl.RemainingPriority(p),
+			RetryAfter: pl.RetryAfterPriority(p),
+		})
+	}
+	return allowed
+}
+
+// Remaining returns how many requests with the lowest priority are
+// allowed until it will be rate limited.
+func (pl *PriorityLimiter) Remaining(string) int {
+	return pl.RemainingPriority(0)
+}
+
+// RetryAfter returns how many seconds one should wait until the next
+// request with the lowest priority is allowed.
+func (pl *PriorityLimiter) RetryAfter(string) int {
+	return pl.RetryAfterPriority(0)
+}
+
+// Oldest implements the RateLimiter interface
+func (pl *PriorityLimiter) Oldest(s string) time.Time {
+	return pl.cb.Oldest(s)
+}
+
+// Delta implements the RateLimiter interface
+func (pl *PriorityLimiter) Delta(s string) time.Duration {
+	return pl.cb.Delta(s)
+}
+
+// Resize resizes the capacity shared by all priorities.
+func (pl *PriorityLimiter) Resize(s string, n int) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.cb.Resize(s, n)
+}
+
+// Reset removes all requests of all priorities.
+func (pl *PriorityLimiter) Reset(s string) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.cb.Reset(s)
+}
+
+// Close implements the RateLimiter interface
+func (pl *PriorityLimiter) Close() {
+	pl.cb.Close()
+}
@@ -0,0 +1,94 @@
+package circularbuffer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	analytics Priority = iota
+	search
+	payments
+)
+
+func TestPriorityLimiterReservedCapacity(t *testing.T) {
+	clock := newFakeClock()
+	pl, err := NewPriorityLimiter(10, time.Second, []float64{0.5, 0.8, 1}, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pl.Close()
+
+	allowed := func(p Priority, n int) int {
+		a := 0
+		for i := 0; i < n; i++ {
+			if pl.AllowPriority(t.Context(), p) {
+				a++
+			}
+			clock.Advance(time.Millisecond)
+		}
+		return a
+	}
+
+	if n := allowed(analytics, 10); n != 5 {
+		t.Errorf("analytics should use 50%%, got %d", n)
+	}
+	if n := pl.RemainingPriority(search); n != 3 {
+		t.Errorf("expected 3 remaining for search, got %d", n)
+	}
+	if n := allowed(search, 10); n != 3 {
+		t.Errorf("search should use up to 80%%, got %d", n)
+	}
+	if n := allowed(payments, 10); n != 2 {
+		t.Errorf("payments should use the reserved remainder, got %d", n)
+	}
+	if pl.Allow(t.Context(), "") {
+		t.Errorf("Allow should use the lowest priority")
+	}
+
+	// the 5 analytics hits expire first, then analytics is still
+	// above its 50% share with 5 other hits
+	clock.Advance(time.Second - 24*time.Millisecond)
+	if n := pl.RemainingPriority(payments); n != 5 {
+		t.Errorf("expected 5 remaining for payments, got %d", n)
+	}
+	if n := pl.RemainingPriority(analytics); n != 0 {
+		t.Errorf("expected 0 remaining for analytics, got %d", n)
+	}
+	if n := pl.RetryAfterPriority(analytics); n != 1 {
+		t.Errorf("expected analytics to retry after 1s, got %d", n)
+	}
+	if n := pl.RetryAfterPriority(payments); n != 0 {
+		t.Errorf("expected payments to retry now, got %d", n)
+	}
+}
+
+func TestPriorityLimiterUnknownPriority(t *testing.T) {
+	pl, err := NewPriorityLimiter(4, time.Minute, []float64{0.5, 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pl.Close()
+	for i := 0; i < 4; i++ {
+		if !pl.AllowPriority(t.Context(), 7) {
+			t.Errorf("priorities above the configured ones should use all capacity")
+		}
+	}
+	if pl.AllowPriority(t.Context(), -1) {
+		t.Errorf("negative priorities should use the lowest priority")
+	}
+}
+
+func TestPriorityLimiterInvalidFractions(t *testing.T) {
+	for _, fractions := range [][]float64{nil, {0}, {1.5}, {0.8, 0.5}} {
+		if _, err := NewPriorityLimiter(10, time.Second, fractions); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%v: expected ErrInvalidArgument, got %v", fractions, err)
+		}
+	}
+	for _, opt := range []Option{WithAlgorithm(Smoothed), WithMinInterval(time.Second)} {
+		if _, err := NewPriorityLimiter(10, time.Second, []float64{1}, opt); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("expected ErrInvalidArgument for smoothing, got %v", err)
+		}
+	}
+}
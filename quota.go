@@ -0,0 +1,439 @@
+package circularbuffer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Schedule defines calendar periods of a quota, for example days or
+// months, after which the quota is reset.
+type Schedule interface {
+	// Start returns the start of the period containing t.
+	Start(t time.Time) time.Time
+	// Next returns the start of the period after the one
+	// containing t.
+	Next(t time.Time) time.Time
+}
+
+type calendar struct {
+	months bool
+	loc    *time.Location
+}
+
+// Daily returns a Schedule, that resets quotas at midnight in loc.
+func Daily(loc *time.Location) Schedule {
+	return calendar{loc: loc}
+}
+
+// Monthly returns a Schedule, that resets quotas at midnight of the
+// 1st of each month in loc.
+func Monthly(loc *time.Location) Schedule {
+	return calendar{months: true, loc: loc}
+}
+
+func (c calendar) Start(t time.Time) time.Time {
+	t = t.In(c.loc)
+	if c.months {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, c.loc)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, c.loc)
+}
+
+func (c calendar) Next(t time.Time) time.Time {
+	if c.months {
+		return c.Start(t).AddDate(0, 1, 0)
+	}
+	return c.Start(t).AddDate(0, 0, 1)
+}
+
+// QuotaState is the persisted usage of a key of a QuotaLimiter.
+type QuotaState struct {
+	Key string `json:"key"`
+	// Limit is the limit of the key set by Resize, 0 means the
+	// default limit.
+	Limit int `json:"limit,omitempty"`
+	// Period is the start of the calendar period of the counts.
+	Period time.Time `json:"period,omitzero"`
+	// Bucket is the number of the newest bucket, the time of the
+	// bucket is Bucket * bucket duration since the Unix epoch.
+	Bucket int64 `json:"bucket,omitempty"`
+	// Counts are the hits per bucket, the newest bucket is
+	// Counts[Bucket % len(Counts)].
+	Counts []uint32 `json:"counts"`
+}
+
+// QuotaStore persists the usage of a QuotaLimiter, such that quotas
+// survive restarts.
+type QuotaStore interface {
+	Load(ctx context.Context) ([]QuotaState, error)
+	Save(ctx context.Context, states []QuotaState) error
+}
+
+// FileQuotaStore is a QuotaStore, that stores quotas as JSON file.
+type FileQuotaStore struct {
+	Path string
+}
+
+// Load returns the quotas stored in the file. A missing file is no
+// error.
+func (fs FileQuotaStore) Load(context.Context) ([]QuotaState, error) {
+	buf, err := os.ReadFile(fs.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var states []QuotaState
+	err = json.Unmarshal(buf, &states)
+	return states, err
+}
+
+// Save replaces the file by the given quotas.
+func (fs FileQuotaStore) Save(_ context.Context, states []QuotaState) error {
+	buf, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	tmp := fs.Path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fs.Path)
+}
+
+// WithQuotaStore sets the QuotaStore of a QuotaLimiter. The stored
+// quotas are loaded on creation and saved by Flush, by the cleanup
+// goroutine and on Close.
+func WithQuotaStore(s QuotaStore) Option {
+	return func(c *config) {
+		c.quotaStore = s
+	}
+}
+
+// QuotaLimiter limits the number of requests per key over long time
+// windows, like days or months, where a CircularBuffer would need to
+// store one timestamp per allowed request. It either counts requests
+// in a rolling window of fixed size buckets, for example a 30 day
+// window of 1 hour buckets, or in calendar periods, for example
+// monthly, that reset on the 1st.
+type QuotaLimiter struct {
+	mu       sync.Mutex
+	states   map[string]*QuotaState
+	limit    int
+	bucket   time.Duration
+	n        int
+	schedule Schedule
+	conf     *config
+	quitCH   chan struct{}
+}
+
+// NewQuotaLimiter returns a QuotaLimiter, that allows limit requests
+// per key within a rolling window, which is counted in buckets of the
+// given duration. The window is rounded up to a multiple of bucket.
+func NewQuotaLimiter(limit int, window, bucket time.Duration, opts ...Option) (*QuotaLimiter, error) {
+	if bucket <= 0 || bucket > window {
+		return nil, &ArgumentError{Name: "bucket", Value: bucket}
+	}
+	// the cleanup goroutine defaults to run once per bucket
+	c, err := newConfig(limit, bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	n := int((window + bucket - 1) / bucket)
+	return newQuotaLimiter(c, bucket, n, nil)
+}
+
+// NewCalendarQuotaLimiter returns a QuotaLimiter, that allows limit
+// requests per key within each period of the Schedule s.
+func NewCalendarQuotaLimiter(limit int, s Schedule, opts ...Option) (*QuotaLimiter, error) {
+	if s == nil {
+		return nil, &ArgumentError{Name: "schedule", Value: s}
+	}
+	c, err := newConfig(limit, time.Hour, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newQuotaLimiter(c, 0, 1, s)
+}
+
+func newQuotaLimiter(c *config, bucket time.Duration, n int, s Schedule) (*QuotaLimiter, error) {
+	ql := &QuotaLimiter{
+		states:   make(map[string]*QuotaState),
+		limit:    c.maxHits,
+		bucket:   bucket,
+		n:        n,
+		schedule: s,
+		conf:     c,
+		quitCH:   make(chan struct{}),
+	}
+	if c.quotaStore != nil {
+		states, err := c.quotaStore.Load(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		ql.Import(states)
+	}
+	go ql.startCleanerDaemon(c.cleanInterval)
+	return ql, nil
+}
+
+// advance resets the buckets, that are outside the window at now,
+// and returns the index of the current bucket.
+// needs to be called with mu held by caller
+func (ql *QuotaLimiter) advance(st *QuotaState, now time.Time) int {
+	if ql.schedule != nil {
+		if start := ql.schedule.Start(now); !start.Equal(st.Period) {
+			st.Period = start
+			st.Counts[0] = 0
+		}
+		return 0
+	}
+	b := now.UnixNano() / int64(ql.bucket)
+	if b-st.Bucket >= int64(ql.n) {
+		clear(st.Counts)
+	} else {
+		for i := st.Bucket + 1; i <= b; i++ {
+			st.Counts[i%int64(ql.n)] = 0
+		}
+	}
+	if b > st.Bucket {
+		st.Bucket = b
+	}
+	return int(st.Bucket % int64(ql.n))
+}
+
+// needs to be called with mu held by caller
+func (ql *QuotaLimiter) used(st *QuotaState) int {
+	var sum int
+	for _, c := range st.Counts {
+		sum += int(c)
+	}
+	return sum
+}
+
+// needs to be called with mu held by caller
+func (ql *QuotaLimiter) limitOf(st *QuotaState) int {
+	if st.Limit > 0 {
+		return st.Limit
+	}
+	return ql.limit
+}
+
+// needs to be called with mu held by caller
+func (ql *QuotaLimiter) state(s string, create bool) *QuotaState {
+	st, ok := ql.states[s]
+	if !ok && create {
+		st = &QuotaState{Key: s, Counts: make([]uint32, ql.n)}
+		ql.states[s] = st
+	}
+	return st
+}
+
+// Allow returns true and counts the request, if the key s has quota
+// left in the current window or period. A request with a cost attached
+// by ContextWithCost counts as many requests. If ctx is done, Allow
+// returns false without counting the request.
+func (ql *QuotaLimiter) Allow(ctx context.Context, s string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	s = keyOf(ctx, s)
+	cost := CostFromContext(ctx)
+	now := ql.conf.clock.Now()
+	ql.mu.Lock()
+	st := ql.state(s, true)
+	i := ql.advance(st, now)
+	ok := ql.used(st)+cost <= ql.limitOf(st) && uint64(st.Counts[i])+uint64(cost) <= math.MaxUint32
+	if ok {
+		st.Counts[i] += uint32(cost)
+	}
+	ql.mu.Unlock()
+	if ok {
+		ql.conf.hooks.allow(s)
+	} else {
+		ql.conf.hooks.reject(s)
+	}
+	recordDecision(ctx, ql, s, ok)
+	return ok
+}
+
+// Remaining returns how many requests of the key s are allowed in the
+// current window or period.
+func (ql *QuotaLimiter) Remaining(s string) int {
+	now := ql.conf.clock.Now()
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	st := ql.state(s, false)
+	if st == nil {
+		return ql.limit
+	}
+	ql.advance(st, now)
+	return max(0, ql.limitOf(st)-ql.used(st))
+}
+
+// ResetAt returns the time at which the key s will have quota left
+// again, which is now if it has quota left.
+func (ql *QuotaLimiter) ResetAt(s string) time.Time {
+	now := ql.conf.clock.Now()
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	st := ql.state(s, false)
+	if st == nil {
+		return now
+	}
+	ql.advance(st, now)
+	used, limit := ql.used(st), ql.limitOf(st)
+	if used < limit {
+		return now
+	}
+	if ql.schedule != nil {
+		return ql.schedule.Next(now)
+	}
+	// drop the oldest buckets until the quota is not exhausted
+	for b := st.Bucket - int64(ql.n) + 1; b <= st.Bucket; b++ {
+		used -= int(st.Counts[b%int64(ql.n)])
+		if used < limit {
+			return time.Unix(0, (b+int64(ql.n))*int64(ql.bucket))
+		}
+	}
+	return time.Unix(0, (st.Bucket+int64(ql.n))*int64(ql.bucket))
+}
+
+// RetryAfter returns how many seconds one should wait until the next
+// request of the key s is allowed.
+func (ql *QuotaLimiter) RetryAfter(s string) int {
+	d := ql.ResetAt(s).Sub(ql.conf.clock.Now())
+	return int(math.Ceil(d.Seconds()))
+}
+
+// Oldest returns the start of the current period or the start of the
+// oldest bucket with hits of the key s.
+func (ql *QuotaLimiter) Oldest(s string) time.Time {
+	now := ql.conf.clock.Now()
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	st := ql.state(s, false)
+	if st == nil {
+		return time.Time{}
+	}
+	ql.advance(st, now)
+	if ql.schedule != nil {
+		return st.Period
+	}
+	for b := st.Bucket - int64(ql.n) + 1; b <= st.Bucket; b++ {
+		if st.Counts[b%int64(ql.n)] > 0 {
+			return time.Unix(0, b*int64(ql.bucket))
+		}
+	}
+	return time.Time{}
+}
+
+// Delta returns the time since Oldest.
+func (ql *QuotaLimiter) Delta(s string) time.Duration {
+	oldest := ql.Oldest(s)
+	if oldest.IsZero() {
+		return time.Duration(time.Hour * 24)
+	}
+	return ql.conf.clock.Now().Sub(oldest)
+}
+
+// Resize sets the limit of the key s to n.
+func (ql *QuotaLimiter) Resize(s string, n int) error {
+	if n <= 0 {
+		return &ArgumentError{Name: "size", Value: n}
+	}
+	ql.mu.Lock()
+	ql.state(s, true).Limit = n
+	ql.mu.Unlock()
+	return nil
+}
+
+// Reset removes all counted requests of the key s and keeps its
+// limit.
+func (ql *QuotaLimiter) Reset(s string) {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	st := ql.state(s, false)
+	if st == nil {
+		return
+	}
+	if st.Limit == 0 {
+		delete(ql.states, s)
+		return
+	}
+	clear(st.Counts)
+}
+
+// Export returns the state of all keys, for example to persist it.
+func (ql *QuotaLimiter) Export() []QuotaState {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	states := make([]QuotaState, 0, len(ql.states))
+	for _, st := range ql.states {
+		cp := *st
+		cp.Counts = append([]uint32(nil), st.Counts...)
+		states = append(states, cp)
+	}
+	return states
+}
+
+// Import replaces the state of the given keys. States with a number
+// of buckets, that does not match the QuotaLimiter, are skipped.
+func (ql *QuotaLimiter) Import(states []QuotaState) {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	for _, st := range states {
+		if len(st.Counts) != ql.n {
+			continue
+		}
+		cp := st
+		cp.Counts = append([]uint32(nil), st.Counts...)
+		ql.states[st.Key] = &cp
+	}
+}
+
+// Flush saves the state of all keys to the QuotaStore.
+func (ql *QuotaLimiter) Flush(ctx context.Context) error {
+	if ql.conf.quotaStore == nil {
+		return nil
+	}
+	return ql.conf.quotaStore.Save(ctx, ql.Export())
+}
+
+// DeleteOld removes keys without hits in the current window or
+// period and without a custom limit.
+func (ql *QuotaLimiter) DeleteOld() {
+	now := ql.conf.clock.Now()
+	ql.mu.Lock()
+	for k, st := range ql.states {
+		ql.advance(st, now)
+		if st.Limit == 0 && ql.used(st) == 0 {
+			delete(ql.states, k)
+		}
+	}
+	ql.mu.Unlock()
+}
+
+// Close stops the cleanup goroutine and saves the state of all keys
+// to the QuotaStore. Call Flush before Close to handle errors.
+func (ql *QuotaLimiter) Close() {
+	close(ql.quitCH)
+	_ = ql.Flush(context.Background())
+}
+
+func (ql *QuotaLimiter) startCleanerDaemon(d time.Duration) {
+	for {
+		select {
+		case <-ql.quitCH:
+			return
+		case <-time.After(d):
+			ql.DeleteOld()
+			_ = ql.Flush(context.Background())
+		}
+	}
+}
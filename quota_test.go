@@ -0,0 +1,170 @@
+package circularbuffer
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotaLimiterRolling(t *testing.T) {
+	clock := newFakeClock()
+	ql, err := NewQuotaLimiter(3, 3*time.Hour, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ql.Close()
+
+	// hits at 0h, 1h, 1h
+	ql.Allow(t.Context(), "foo")
+	clock.Advance(time.Hour)
+	ql.Allow(t.Context(), "foo")
+	ql.Allow(t.Context(), "foo")
+	if ql.Allow(t.Context(), "foo") {
+		t.Errorf("foo should be out of quota")
+	}
+	if n := ql.Remaining("foo"); n != 0 {
+		t.Errorf("expected 0 remaining, got %d", n)
+	}
+	if n := ql.Remaining("bar"); n != 3 {
+		t.Errorf("expected 3 remaining for unknown key, got %d", n)
+	}
+	if at := ql.ResetAt("foo"); !at.Equal(clock.Now().Add(2 * time.Hour)) {
+		t.Errorf("expected reset in 2h, got %s", at.Sub(clock.Now()))
+	}
+	if n := ql.RetryAfter("foo"); n != 7200 {
+		t.Errorf("expected retry after 7200s, got %d", n)
+	}
+
+	clock.Advance(2 * time.Hour) // the 0h bucket expired
+	if n := ql.Remaining("foo"); n != 1 {
+		t.Errorf("expected 1 remaining, got %d", n)
+	}
+	if !ql.Allow(t.Context(), "foo") || ql.Allow(t.Context(), "foo") {
+		t.Errorf("foo should be allowed exactly once")
+	}
+
+	clock.Advance(10 * time.Hour)
+	if n := ql.Remaining("foo"); n != 3 {
+		t.Errorf("expected 3 remaining after the window, got %d", n)
+	}
+	ql.DeleteOld()
+	if len(ql.states) != 0 {
+		t.Errorf("expected unused keys to be deleted, got %d", len(ql.states))
+	}
+}
+
+func TestQuotaLimiterMonthly(t *testing.T) {
+	clock := newFakeClock()
+	clock.now = time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)
+	ql, err := NewCalendarQuotaLimiter(2, Monthly(time.UTC), WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ql.Close()
+
+	if !ql.Allow(t.Context(), "foo") || !ql.Allow(t.Context(), "foo") || ql.Allow(t.Context(), "foo") {
+		t.Errorf("foo should be allowed twice")
+	}
+	feb := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	if at := ql.ResetAt("foo"); !at.Equal(feb) {
+		t.Errorf("expected reset at %s, got %s", feb, at)
+	}
+	if !ql.Oldest("foo").Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected period start %s", ql.Oldest("foo"))
+	}
+
+	clock.Advance(time.Hour)
+	if n := ql.Remaining("foo"); n != 2 {
+		t.Errorf("expected quota to be reset on the 1st, remaining %d", n)
+	}
+}
+
+func TestDailySchedule(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	s := Daily(loc)
+	now := time.Date(2024, 3, 10, 23, 30, 0, 0, time.UTC) // 01:30 on the 11th in loc
+	if want := time.Date(2024, 3, 11, 0, 0, 0, 0, loc); !s.Start(now).Equal(want) {
+		t.Errorf("expected start %s, got %s", want, s.Start(now))
+	}
+	if want := time.Date(2024, 3, 12, 0, 0, 0, 0, loc); !s.Next(now).Equal(want) {
+		t.Errorf("expected next %s, got %s", want, s.Next(now))
+	}
+}
+
+func TestQuotaLimiterResize(t *testing.T) {
+	ql, err := NewQuotaLimiter(1, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ql.Close()
+
+	if err := ql.Resize("foo", 0); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	if err := ql.Resize("foo", 2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ql.Allow(t.Context(), "foo") || !ql.Allow(t.Context(), "foo") || ql.Allow(t.Context(), "foo") {
+		t.Errorf("foo should be allowed twice")
+	}
+}
+
+func TestQuotaLimiterPersistence(t *testing.T) {
+	clock := newFakeClock()
+	store := FileQuotaStore{Path: filepath.Join(t.TempDir(), "quota.json")}
+	ql, err := NewQuotaLimiter(5, 24*time.Hour, time.Hour, WithClock(clock), WithQuotaStore(store))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		ql.Allow(t.Context(), "foo")
+	}
+	if err := ql.Flush(t.Context()); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	ql.Close()
+
+	clock.Advance(time.Hour)
+	restarted, err := NewQuotaLimiter(5, 24*time.Hour, time.Hour, WithClock(clock), WithQuotaStore(store))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer restarted.Close()
+	if n := restarted.Remaining("foo"); n != 2 {
+		t.Errorf("expected quota to survive the restart, remaining %d", n)
+	}
+}
+
+func TestQuotaLimiterInvalid(t *testing.T) {
+	if _, err := NewQuotaLimiter(1, time.Hour, 2*time.Hour); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	if _, err := NewCalendarQuotaLimiter(1, nil); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+func TestQuotaLimiterReset(t *testing.T) {
+	ql, err := NewQuotaLimiter(1, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ql.Close()
+
+	ql.Allow(t.Context(), "foo")
+	ql.Reset("foo")
+	if !ql.Allow(t.Context(), "foo") {
+		t.Errorf("foo should be allowed after reset")
+	}
+
+	if err := ql.Resize("bar", 2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ql.Allow(t.Context(), "bar")
+	ql.Allow(t.Context(), "bar")
+	ql.Reset("bar")
+	if n := ql.Remaining("bar"); n != 2 {
+		t.Errorf("expected reset to keep limit 2, got remaining %d", n)
+	}
+}
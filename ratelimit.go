@@ -3,7 +3,6 @@ package circularbuffer
 import (
 	"context"
 	"math"
-	"sync"
 	"time"
 )
 
@@ -18,9 +17,16 @@ type RateLimiter interface {
 	Close()
 	Oldest(string) time.Time
 	Delta(string) time.Duration
-	Resize(string, int)
+	// Resize changes the number of allowed hits per time window
+	Resize(string, int) error
+	// Remaining returns how many requests are allowed until the
+	// next request will be rate limited
+	Remaining(string) int
 	// RetryAfter returns how many seconds until the next allowed request
 	RetryAfter(string) int
+	// Reset removes all requests of the given key, such that it is
+	// not rate limited anymore
+	Reset(string)
 }
 
 // NewRateLimiter returns a new initialized RateLimitter with maxHits
@@ -32,40 +38,78 @@ func NewRateLimiter(maxHits int, d time.Duration) RateLimiter {
 }
 
 // Allow returns true if there is a free bucket and we should not rate
-// limit, if not it will return false, which means ratelimit.
+// limit, if not it will return false, which means ratelimit. A request
+// with a cost attached by ContextWithCost needs as many free buckets.
+// If ctx is done, Allow returns false without counting the request.
+// With a maximum delay, see WithMaxDelay, Allow blocks until an early
+// request is due.
 func (cb *CircularBuffer) Allow(ctx context.Context, s string) bool {
-	return cb.Add(time.Now())
+	if ctx.Err() != nil {
+		return false
+	}
+	s = keyOf(ctx, s)
+	allowed := cb.take(ctx, CostFromContext(ctx))
+	if allowed {
+		cb.hooks.allow(s)
+	} else {
+		cb.hooks.reject(s)
+	}
+	recordDecision(ctx, cb, s, allowed)
+	return allowed
 }
 
 // Close implements the RateLimiter interface to shutdown, nothing to
 // do.
 func (*CircularBuffer) Close() {}
 
-// Oldest implements the RateLimiter interface
+// Oldest implements the RateLimiter interface and returns the time of
+// the oldest request in the buffer.
+// With a burst, see WithBurst, the buffer stores the times the
+// requests are scheduled at, which can be in the future.
 func (cb *CircularBuffer) Oldest(string) time.Time {
-	cb.RLock()
-	cur := cb.slots[cb.offset]
-	cb.RUnlock()
-	return cur
+	return cb.Next()
 }
 
-// Current implements the RateLimiter interface
+// Current implements the RateLimiter interface and returns the time of
+// the newest request in the buffer.
+// With a burst, see WithBurst, the buffer stores the times the
+// requests are scheduled at, which can be in the future.
 func (cb *CircularBuffer) Current(string) time.Time {
 	return cb.current()
 }
 
 // Delta returns the diffence between the current and the oldest value in
-// the buffer, i.e. maxHits / Delta() => rate
+// the buffer, i.e. maxHits / Delta() => rate. With a burst, the values
+// are scheduled at least timeWindow/maxHits apart, so Delta is the
+// span of the requests at the sustained rate, not the time their burst
+// took to arrive.
 func (cb *CircularBuffer) Delta(string) time.Duration {
 	return cb.delta()
 }
 
 // Resize resizes the circular buffer to the given size. Resizing to a size
-// <= 0 is not performed
-func (cb *CircularBuffer) Resize(_ string, n int) {
-	cb.Lock()
-	cb.resize(n)
-	cb.Unlock()
+// <= 0 is not performed and returns an *ArgumentError.
+func (cb *CircularBuffer) Resize(_ string, n int) error {
+	return cb.resize(n)
+}
+
+// Reconfigure changes the number of allowed hits to maxHits and the
+// time window to window and keeps the burst. The newest
+// min(maxHits+burst, Cap) requests are kept, older requests are
+// dropped, and the new window applies to the kept requests
+// immediately. After growing, Oldest returns the zero
+// time and RetryAfter 0 until the buffer is full again. After
+// shrinking, Oldest returns the oldest kept request and RetryAfter the
+// time until it leaves the new window. Invalid arguments are not
+// applied and return an *ArgumentError.
+func (cb *CircularBuffer) Reconfigure(_ string, maxHits int, window time.Duration) error {
+	return cb.reconfigure(maxHits, window)
+}
+
+// Remaining implements the RateLimiter interface and returns the
+// number of free slots in the current time window.
+func (cb *CircularBuffer) Remaining(string) int {
+	return cb.Cap() - cb.Len()
 }
 
 // RetryAfter returns how many seconds one should wait until the next request
@@ -77,139 +121,30 @@ func (cb *CircularBuffer) RetryAfter(string) int {
 	return int(secs)
 }
 
+// Reset removes all requests from the buffer.
+func (cb *CircularBuffer) Reset(string) {
+	cb.reset()
+}
+
 // ClientRateLimiter implements the RateLimiter interface and does
 // rate limiting based on the the String passed to Allow(). This can
 // be used to limit per client calls to the backend. For example you
 // can slow down user enumeration or dictionary attacks to /login
 // APIs.
-type ClientRateLimiter struct {
-	sync.RWMutex
-	bag        map[string]*CircularBuffer
-	maxHits    int
-	timeWindow time.Duration
-	quitCH     chan struct{}
-}
+type ClientRateLimiter = KeyedLimiter[string]
 
 // NewClientRateLimiter returns a new initialized ClientRateLimiter with maxHits is
 // the maximal number of hits per time.Duration d.
 func NewClientRateLimiter(maxHits int, d, cleanInterval time.Duration) *ClientRateLimiter {
-	quit := make(chan struct{})
-	crl := &ClientRateLimiter{
-		bag:        make(map[string]*CircularBuffer),
-		maxHits:    maxHits,
-		timeWindow: d,
-		quitCH:     quit,
-	}
-	go crl.startCleanerDaemon(cleanInterval)
-	return crl
-}
-
-// Allow tries to add s to a circularbuffer and returns true if we have
-// a free bucket, if not it will return false, which means ratelimit with an additional
-// context.Context.
-func (rl *ClientRateLimiter) Allow(ctx context.Context, s string) bool {
-	var source *CircularBuffer
-	var present bool
-
-	rl.RLock()
-	if source, present = rl.bag[s]; !present {
-		rl.RUnlock()
-		rl.Lock()
-		source = NewCircularBuffer(rl.maxHits, rl.timeWindow)
-		rl.bag[s] = source
-		rl.Unlock()
-	} else {
-		rl.RUnlock()
-	}
-	present = source.Add(time.Now())
-	return present
+	c := defaultConfig(maxHits, d)
+	c.cleanInterval = cleanInterval
+	return newKeyedLimiter[string](c, NewMapStore[string]())
 }
 
-func (rl *ClientRateLimiter) Oldest(s string) time.Time {
-	rl.RLock()
-	if _, present := rl.bag[s]; !present {
-		rl.RUnlock()
-		return time.Time{}
-	}
-	delta := rl.bag[s].Oldest(s)
-	rl.RUnlock()
-	return delta
-}
-
-func (rl *ClientRateLimiter) Current(s string) time.Time {
-	rl.RLock()
-	if _, present := rl.bag[s]; !present {
-		rl.RUnlock()
-		return time.Time{}
-	}
-	delta := rl.bag[s].Current(s)
-	rl.RUnlock()
-	return delta
-}
-
-// Delta returns the diffence between the current and the oldest value in
-// the buffer, i.e. maxHits / Delta() => rate
-func (rl *ClientRateLimiter) Delta(s string) time.Duration {
-	rl.RLock()
-	if _, present := rl.bag[s]; !present {
-		rl.RUnlock()
-		return time.Duration(time.Hour * 24)
-	}
-	delta := rl.bag[s].delta()
-	rl.RUnlock()
-	return delta
-}
-
-// Resize resizes the given circular buffer to the given size. Resizing to a size
-// <= 0 is not performed
-func (rl *ClientRateLimiter) Resize(s string, n int) {
-	rl.RLock()
-	if _, present := rl.bag[s]; !present {
-		rl.RUnlock()
-		return
-	}
-	rl.RUnlock()
-	rl.Lock()
-	rl.bag[s].resize(n)
-	rl.Unlock()
-}
-
-// RetryAfter returns how many seconds one should wait until the next request
-// is allowed.
-func (rl *ClientRateLimiter) RetryAfter(s string) int {
-	rl.RLock()
-	if _, present := rl.bag[s]; !present {
-		rl.RUnlock()
-		return 0
-	}
-	retryAfter := rl.bag[s].RetryAfter(s)
-	rl.RUnlock()
-	return retryAfter
-}
-
-// DeleteOld removes old entries from state bag
-func (rl *ClientRateLimiter) DeleteOld() {
-	rl.Lock()
-	for k, cb := range rl.bag {
-		if !cb.InUse() {
-			delete(rl.bag, k)
-		}
-	}
-	rl.Unlock()
-}
-
-// Close will stop the cleanup goroutine
-func (rl *ClientRateLimiter) Close() {
-	close(rl.quitCH)
-}
-
-func (rl *ClientRateLimiter) startCleanerDaemon(d time.Duration) {
-	for {
-		select {
-		case <-rl.quitCH:
-			return
-		case <-time.After(d):
-			rl.DeleteOld()
-		}
-	}
+// NewClientRateLimiterWithOptions returns a new initialized
+// ClientRateLimiter with maxHits per time.Duration d configured by
+// opts. It returns an *ArgumentError if maxHits, d or an option are
+// invalid.
+func NewClientRateLimiterWithOptions(maxHits int, d time.Duration, opts ...Option) (*ClientRateLimiter, error) {
+	return NewKeyedLimiter[string](maxHits, d, opts...)
 }
@@ -61,19 +61,19 @@ func TestClientRateLimiterDeleteOld(t *testing.T) {
 	rl.Allow(context.Background(), "foo")
 	rl.Allow(context.Background(), "bar")
 	rl.DeleteOld()
-	if _, ok := rl.bag["foo"]; !ok {
+	if _, ok := rl.store.Get("foo"); !ok {
 		t.Errorf("foo should be found")
 	}
-	if _, ok := rl.bag["bar"]; !ok {
+	if _, ok := rl.store.Get("bar"); !ok {
 		t.Errorf("bar should be found")
 	}
 
 	time.Sleep(window)
 	rl.DeleteOld()
-	if _, ok := rl.bag["foo"]; ok {
+	if _, ok := rl.store.Get("foo"); ok {
 		t.Errorf("foo should not be found")
 	}
-	if _, ok := rl.bag["bar"]; ok {
+	if _, ok := rl.store.Get("bar"); ok {
 		t.Errorf("bar should not be found")
 	}
 	rl.Close()
@@ -555,3 +555,40 @@ func BenchmarkClientRateLimiterRetryAfterConcurrent1000(b *testing.B) {
 	wg.Wait()
 	rl.Close()
 }
+
+func BenchmarkRateLimiterAllowParallel(b *testing.B) {
+	window := 1 * time.Second
+	rl := NewRateLimiter(1<<21, window)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rl.Allow(context.Background(), "")
+		}
+	})
+	rl.Close()
+}
+
+func TestClientRateLimiterRemaining(t *testing.T) {
+	window := 1 * time.Second
+	rl := newClientRateLimiter(2, window)
+	defer rl.Close()
+
+	if n := rl.Remaining("foo"); n != 2 {
+		t.Errorf("unknown client should have 2 remaining, but has %d", n)
+	}
+	rl.Allow(context.Background(), "foo")
+	if n := rl.Remaining("foo"); n != 1 {
+		t.Errorf("foo should have 1 remaining, but has %d", n)
+	}
+	rl.Allow(context.Background(), "foo")
+	if n := rl.Remaining("foo"); n != 0 {
+		t.Errorf("foo should have 0 remaining, but has %d", n)
+	}
+	if n := rl.Remaining("bar"); n != 2 {
+		t.Errorf("bar should have 2 remaining, but has %d", n)
+	}
+
+	time.Sleep(window)
+	if n := rl.Remaining("foo"); n != 2 {
+		t.Errorf("foo should have 2 remaining after the window, but has %d", n)
+	}
+}
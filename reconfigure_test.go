@@ -0,0 +1,231 @@
+package circularbuffer
+
+import (
+	"errors"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// bufferModel is the reference model of a CircularBuffer: the times of
+// the last requests in time order, at most capacity many.
+type bufferModel struct {
+	capacity int
+	window   time.Duration
+	times    []time.Time
+}
+
+func (m *bufferModel) next() time.Time {
+	if len(m.times) < m.capacity {
+		return time.Time{}
+	}
+	return m.times[0]
+}
+
+func (m *bufferModel) free(now time.Time) bool {
+	next := m.next()
+	return next.IsZero() || next.Add(m.window).Before(now)
+}
+
+func (m *bufferModel) add(t time.Time) bool {
+	if !m.free(t) {
+		return false
+	}
+	if len(m.times) == m.capacity {
+		m.times = m.times[1:]
+	}
+	m.times = append(m.times, t)
+	return true
+}
+
+func (m *bufferModel) len(now time.Time) int {
+	n := 0
+	for _, t := range m.times {
+		if t.After(now.Add(-m.window)) {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *bufferModel) retryAfter(now time.Time) time.Duration {
+	if m.free(now) {
+		return 0
+	}
+	return m.next().Add(m.window).Sub(now)
+}
+
+func (m *bufferModel) reconfigure(n int, window time.Duration) {
+	if k := len(m.times); k > n {
+		m.times = m.times[k-n:]
+	}
+	m.capacity = n
+	m.window = window
+}
+
+func checkModel(t *testing.T, cb *CircularBuffer, m *bufferModel, now time.Time, step int) {
+	t.Helper()
+	if cb.Cap() != m.capacity {
+		t.Fatalf("step %d: Cap() = %d, want %d", step, cb.Cap(), m.capacity)
+	}
+	if got, want := cb.Len(), m.len(now); got != want {
+		t.Fatalf("step %d: Len() = %d, want %d", step, got, want)
+	}
+	if got, want := cb.Next(), m.next(); !got.Equal(want) {
+		t.Fatalf("step %d: Next() = %v, want %v", step, got, want)
+	}
+	if got, want := cb.retryAfter(), m.retryAfter(now); got != want {
+		t.Fatalf("step %d: retryAfter() = %v, want %v", step, got, want)
+	}
+	var current time.Time
+	if len(m.times) > 0 {
+		current = m.times[len(m.times)-1]
+	}
+	if got := cb.current(); !got.Equal(current) {
+		t.Fatalf("step %d: current() = %v, want %v", step, got, current)
+	}
+	// the ring is ordered from the offset with empty slots first
+	for i := 0; i < cb.Cap(); i++ {
+		want := time.Time{}
+		if j := i - (m.capacity - len(m.times)); j >= 0 {
+			want = m.times[j]
+		}
+		if got := cb.nth(i); !got.Equal(want) {
+			t.Fatalf("step %d: nth(%d) = %v, want %v", step, i, got, want)
+		}
+	}
+}
+
+// TestReconfigureModel runs random sequences of requests, clock
+// advances, resets and reconfigurations against a CircularBuffer and
+// the bufferModel and compares their observable state after every step.
+func TestReconfigureModel(t *testing.T) {
+	seeds := 500
+	if testing.Short() {
+		seeds = 50
+	}
+	for seed := 0; seed < seeds; seed++ {
+		rnd := rand.New(rand.NewPCG(uint64(seed), 42))
+		clock := newFakeClock()
+		capacity := 1 + rnd.IntN(8)
+		window := time.Duration(1+rnd.IntN(10)) * time.Second
+		cb, err := NewCircularBufferWithOptions(capacity, window, WithClock(clock))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		m := &bufferModel{capacity: capacity, window: window}
+
+		for step := 0; step < 200; step++ {
+			switch op := rnd.IntN(100); {
+			case op < 60:
+				now := clock.Now()
+				if got, want := cb.Add(now), m.add(now); got != want {
+					t.Fatalf("seed %d step %d: Add() = %v, want %v", seed, step, got, want)
+				}
+			case op < 80:
+				clock.Advance(time.Duration(rnd.IntN(3000)) * time.Millisecond)
+			case op < 95:
+				n := 1 + rnd.IntN(8)
+				w := time.Duration(1+rnd.IntN(10)) * time.Second
+				if err := cb.Reconfigure("", n, w); err != nil {
+					t.Fatalf("seed %d step %d: unexpected error: %v", seed, step, err)
+				}
+				m.reconfigure(n, w)
+			default:
+				cb.Reset("")
+				m.times = nil
+			}
+			checkModel(t, cb, m, clock.Now(), step)
+		}
+	}
+}
+
+func TestReconfigureSemantics(t *testing.T) {
+	clock := newFakeClock()
+	cb, _ := NewCircularBufferWithOptions(4, 10*time.Second, WithClock(clock))
+	for i := 0; i < 4; i++ {
+		cb.Add(clock.Now())
+		clock.Advance(time.Second)
+	}
+	start := clock.Now().Add(-4 * time.Second)
+
+	// shrinking keeps the newest requests
+	if err := cb.Reconfigure("", 2, 10*time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cb.Oldest(""); !got.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("expected oldest kept request at +2s, got %v", got)
+	}
+	if got := cb.RetryAfter(""); got != 8 {
+		t.Errorf("expected retry after 8s, got %d", got)
+	}
+
+	// a shorter window applies to the kept requests
+	if err := cb.Reconfigure("", 2, 1500*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cb.Len() != 1 || cb.RetryAfter("") != 0 {
+		t.Errorf("expected 1 request in window and no retry, got %d and %d", cb.Len(), cb.RetryAfter(""))
+	}
+
+	// growing allows requests immediately
+	if err := cb.Reconfigure("", 3, time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cb.Oldest("").IsZero() || cb.RetryAfter("") != 0 || cb.Remaining("") != 1 {
+		t.Errorf("expected free slot after growing, got oldest %v, remaining %d", cb.Oldest(""), cb.Remaining(""))
+	}
+
+	for _, tt := range []struct {
+		n   int
+		w   time.Duration
+		arg string
+	}{
+		{0, time.Second, "size"},
+		{1, 0, "timeWindow"},
+	} {
+		err := cb.Reconfigure("", tt.n, tt.w)
+		var ae *ArgumentError
+		if !errors.As(err, &ae) || ae.Name != tt.arg {
+			t.Errorf("Reconfigure(%d, %v): expected ArgumentError for %s, got %v", tt.n, tt.w, tt.arg, err)
+		}
+	}
+	if cb.Cap() != 3 || cb.timeWindow() != time.Minute {
+		t.Errorf("invalid arguments should not be applied")
+	}
+}
+
+func TestKeyedLimiterReconfigure(t *testing.T) {
+	clock := newFakeClock()
+	rl, err := NewClientRateLimiterWithOptions(1, time.Second, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	if err := rl.Reconfigure("foo", 2, time.Minute); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	rl.Allow(t.Context(), "foo")
+	if err := rl.Reconfigure("foo", 2, time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !rl.Allow(t.Context(), "foo") || rl.Allow(t.Context(), "foo") {
+		t.Errorf("foo should be allowed twice per minute")
+	}
+	if got := rl.RetryAfter("foo"); got != 60 {
+		t.Errorf("expected retry after 60s, got %d", got)
+	}
+
+	// expiry uses the window of the key
+	clock.Advance(2 * time.Second)
+	rl.expire()
+	if _, ok := rl.store.Get("foo"); !ok {
+		t.Errorf("foo should not expire before its window")
+	}
+	clock.Advance(time.Minute)
+	rl.expire()
+	if _, ok := rl.store.Get("foo"); ok {
+		t.Errorf("foo should expire after its window")
+	}
+}
@@ -0,0 +1,375 @@
+package circularbuffer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuleConfig is the declarative configuration of a RuleEngine. It can
+// be parsed from YAML or JSON by ParseRules, for example:
+//
+//	rules:
+//	- name: login
+//	  match:
+//	    route: /login
+//	    method: POST
+//	  key: ip
+//	  limit: 10
+//	  window: 1m
+//	- name: api
+//	  match:
+//	    route: /api/*
+//	    headers:
+//	      X-Tenant: "*"
+//	  key: header:X-Api-Key
+//	  limit: 100
+//	  window: 1s
+type RuleConfig struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// Rule maps the requests it matches to a rate limit.
+type Rule struct {
+	// Name identifies the rule. It has to be unique within a
+	// RuleConfig and is used to keep the state of a rule on reload.
+	Name string `json:"name" yaml:"name"`
+	// Match selects the requests of the rule.
+	Match RuleMatch `json:"match" yaml:"match"`
+	// Key selects the key a request is counted for, it is one of
+	// "ip", the client IP of the request, "header:<name>", the value
+	// of the given request header, or "global", a single key for
+	// all requests. It defaults to "ip". Requests without the
+	// configured header do not match the rule.
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+	// Algorithm is the name of the Algorithm, it defaults to
+	// SlidingWindowLog.
+	Algorithm string `json:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+	// Limit is the number of requests per key allowed within Window.
+	Limit int `json:"limit" yaml:"limit"`
+	// Window is the time window of the limit in time.ParseDuration
+	// syntax, for example "1m".
+	Window string `json:"window" yaml:"window"`
+	// Burst is the number of requests allowed on top of Limit, see
+	// WithBurst.
+	Burst int `json:"burst,omitempty" yaml:"burst,omitempty"`
+}
+
+// RuleMatch selects requests by route, method and headers. Empty
+// fields match all requests.
+type RuleMatch struct {
+	// Route matches the URL path exactly or, if it ends with "*",
+	// all paths with the given prefix.
+	Route string `json:"route,omitempty" yaml:"route,omitempty"`
+	// Method matches the HTTP method case insensitive.
+	Method string `json:"method,omitempty" yaml:"method,omitempty"`
+	// Headers match if every header has the given value or, if the
+	// value is "*", is set at all.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+// ParseRules parses a RuleConfig from YAML or JSON. Unknown fields are
+// rejected to catch typos. The rules are not validated before they are
+// passed to NewRuleEngine or RuleEngine.Reload.
+func ParseRules(data []byte) (*RuleConfig, error) {
+	var rc RuleConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+// LoadRules reads and parses the RuleConfig file at path.
+func LoadRules(path string) (*RuleConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(data)
+}
+
+// RuleEngine rate limits HTTP requests by the first Rule matching the
+// request. Every rule has its own ClientRateLimiter. The rules can be
+// replaced at runtime by Reload or Watch, requests in flight are
+// evaluated by either the old or the new rules, but never by a mix of
+// both.
+type RuleEngine struct {
+	mu    sync.Mutex // serializes reloads
+	rules atomic.Pointer[[]*compiledRule]
+	opts  []Option
+}
+
+type compiledRule struct {
+	Rule
+	window  time.Duration
+	keyFunc func(*http.Request) (string, bool)
+	limiter *ClientRateLimiter
+}
+
+// NewRuleEngine returns a RuleEngine of the given rules. The options
+// are applied to the ClientRateLimiter of every rule, for example
+// WithClock or WithMaxKeys. It returns an error, matching
+// ErrInvalidArgument, if a rule is invalid.
+func NewRuleEngine(rc *RuleConfig, opts ...Option) (*RuleEngine, error) {
+	e := &RuleEngine{opts: opts}
+	if err := e.Reload(rc); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload validates the given rules and atomically replaces the rules
+// of the RuleEngine. The state of all keys is kept for a rule with the
+// same name, key, algorithm, limit, window and burst as before, such
+// that changing the match of a rule or adding other rules does not
+// reset rate limits. If a rule is invalid, the current rules are kept
+// and an error matching ErrInvalidArgument is returned.
+func (e *RuleEngine) Reload(rc *RuleConfig) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.rules.Load() == nil {
+		e.rules.Store(&[]*compiledRule{})
+	}
+	old := make(map[string]*compiledRule)
+	for _, r := range *e.rules.Load() {
+		old[r.Name] = r
+	}
+
+	rules := make([]*compiledRule, 0, len(rc.Rules))
+	names := make(map[string]struct{}, len(rc.Rules))
+	for _, r := range rc.Rules {
+		if _, ok := names[r.Name]; ok {
+			closeRules(rules, *e.rules.Load())
+			return &ArgumentError{Name: "rule name", Value: r.Name}
+		}
+		names[r.Name] = struct{}{}
+
+		cr, err := e.compile(r, old[r.Name])
+		if err != nil {
+			closeRules(rules, *e.rules.Load())
+			return err
+		}
+		rules = append(rules, cr)
+	}
+
+	e.rules.Store(&rules)
+	closeRules(slices.Collect(maps.Values(old)), rules)
+	return nil
+}
+
+// closeRules closes the limiters of rules, which are not used by
+// keep.
+func closeRules(rules, keep []*compiledRule) {
+	used := make(map[*ClientRateLimiter]struct{}, len(keep))
+	for _, r := range keep {
+		used[r.limiter] = struct{}{}
+	}
+	for _, r := range rules {
+		if _, ok := used[r.limiter]; !ok {
+			r.limiter.Close()
+		}
+	}
+}
+
+func (e *RuleEngine) compile(r Rule, old *compiledRule) (*compiledRule, error) {
+	field := func(name string) string {
+		return "rules[" + r.Name + "]." + name
+	}
+	if r.Name == "" {
+		return nil, &ArgumentError{Name: "rule name", Value: r.Name}
+	}
+	if r.Match.Method != "" {
+		r.Match.Method = strings.ToUpper(r.Match.Method)
+	}
+	if r.Key == "" {
+		r.Key = "ip"
+	}
+	if r.Algorithm == "" {
+		r.Algorithm = SlidingWindowLog.String()
+	}
+	keyFunc, ok := keyExtractor(r.Key)
+	if !ok {
+		return nil, &ArgumentError{Name: field("key"), Value: r.Key}
+	}
+	a, ok := parseAlgorithm(r.Algorithm)
+	if !ok {
+		return nil, &ArgumentError{Name: field("algorithm"), Value: r.Algorithm}
+	}
+	window, err := time.ParseDuration(r.Window)
+	if err != nil {
+		return nil, &ArgumentError{Name: field("window"), Value: r.Window}
+	}
+	cr := &compiledRule{Rule: r, window: window, keyFunc: keyFunc}
+	if old != nil && old.sameLimit(cr) {
+		cr.limiter = old.limiter
+		return cr, nil
+	}
+	opts := append(slices.Clip(e.opts), WithAlgorithm(a), WithBurst(r.Burst))
+	cr.limiter, err = NewClientRateLimiterWithOptions(r.Limit, window, opts...)
+	if err != nil {
+		var ae *ArgumentError
+		if errors.As(err, &ae) {
+			err = &ArgumentError{Name: field(ae.Name), Value: ae.Value}
+		}
+		return nil, err
+	}
+	return cr, nil
+}
+
+// sameLimit returns true if the state of cr can be used for r.
+func (cr *compiledRule) sameLimit(r *compiledRule) bool {
+	return cr.Key == r.Key &&
+		strings.EqualFold(cr.Algorithm, r.Algorithm) &&
+		cr.Limit == r.Limit &&
+		cr.window == r.window &&
+		cr.Burst == r.Burst
+}
+
+func parseAlgorithm(s string) (Algorithm, bool) {
+	for _, a := range algorithms {
+		if strings.EqualFold(a.String(), s) {
+			return a, true
+		}
+	}
+	return 0, false
+}
+
+func keyExtractor(s string) (func(*http.Request) (string, bool), bool) {
+	switch {
+	case s == "ip":
+		return clientIP, true
+	case s == "global":
+		// not the zero key, which Allow replaces by the key of
+		// ContextWithKey
+		return func(*http.Request) (string, bool) { return "global", true }, true
+	case strings.HasPrefix(s, "header:") && len(s) > len("header:"):
+		name := http.CanonicalHeaderKey(strings.TrimPrefix(s, "header:"))
+		return func(r *http.Request) (string, bool) {
+			v := r.Header.Get(name)
+			return v, v != ""
+		}, true
+	}
+	return nil, false
+}
+
+func clientIP(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr, r.RemoteAddr != ""
+	}
+	return host, true
+}
+
+func (cr *compiledRule) match(r *http.Request) (string, bool) {
+	m := &cr.Match
+	if m.Method != "" && m.Method != r.Method {
+		return "", false
+	}
+	if prefix, ok := strings.CutSuffix(m.Route, "*"); ok {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			return "", false
+		}
+	} else if m.Route != "" && m.Route != r.URL.Path {
+		return "", false
+	}
+	for name, value := range m.Headers {
+		v := r.Header.Get(name)
+		if v == "" || value != "*" && v != value {
+			return "", false
+		}
+	}
+	return cr.keyFunc(r)
+}
+
+// Allow returns true if the request r is allowed by the first rule
+// matching it and the matching rule. Requests not matching any rule
+// are allowed and the returned rule is nil.
+func (e *RuleEngine) Allow(r *http.Request) (bool, *Rule) {
+	for _, cr := range *e.rules.Load() {
+		if key, ok := cr.match(r); ok {
+			return cr.limiter.Allow(r.Context(), key), &cr.Rule
+		}
+	}
+	return true, nil
+}
+
+// RetryAfter returns how many seconds one should wait until the next
+// request like r is allowed.
+func (e *RuleEngine) RetryAfter(r *http.Request) int {
+	for _, cr := range *e.rules.Load() {
+		if key, ok := cr.match(r); ok {
+			return cr.limiter.RetryAfter(key)
+		}
+	}
+	return 0
+}
+
+// Limiter returns the ClientRateLimiter of the rule with the given
+// name, for example to inspect the state of a key.
+func (e *RuleEngine) Limiter(name string) (*ClientRateLimiter, bool) {
+	for _, cr := range *e.rules.Load() {
+		if cr.Name == name {
+			return cr.limiter, true
+		}
+	}
+	return nil, false
+}
+
+// Watch loads the RuleConfig file at path and polls it every interval
+// to reload the rules if the file was changed, until ctx is done. Errors of
+// reading, parsing or validating the file are passed to onError, which
+// may be nil, and the current rules are kept.
+func (e *RuleEngine) Watch(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	var last fileVersion
+	for {
+		fi, err := os.Stat(path)
+		if err == nil {
+			v := fileVersion{fi.ModTime(), fi.Size()}
+			if !v.modTime.Equal(last.modTime) || v.size != last.size {
+				last = v
+				var rc *RuleConfig
+				if rc, err = LoadRules(path); err == nil {
+					err = e.Reload(rc)
+				}
+			}
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// Close closes the limiters of all rules.
+func (e *RuleEngine) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, cr := range *e.rules.Load() {
+		cr.limiter.Close()
+	}
+}
@@ -0,0 +1,311 @@
+package circularbuffer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRules = `
+rules:
+- name: login
+  match:
+    route: /login
+    method: post
+  limit: 2
+  window: 1m
+- name: api
+  match:
+    route: /api/*
+    headers:
+      X-Tenant: "*"
+  key: header:X-Api-Key
+  limit: 3
+  window: 1s
+`
+
+func newTestRuleEngine(t *testing.T, data string, opts ...Option) *RuleEngine {
+	t.Helper()
+	rc, err := ParseRules([]byte(data))
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	e, err := NewRuleEngine(rc, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create rule engine: %v", err)
+	}
+	t.Cleanup(e.Close)
+	return e
+}
+
+func TestRuleEngineAllow(t *testing.T) {
+	e := newTestRuleEngine(t, testRules, WithClock(newFakeClock()))
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("POST", "/login", nil)
+		if ok, rule := e.Allow(r); !ok || rule == nil || rule.Name != "login" {
+			t.Fatalf("Request %d: Allow() = %v, %v", i, ok, rule)
+		}
+	}
+	r := httptest.NewRequest("POST", "/login", nil)
+	if ok, _ := e.Allow(r); ok {
+		t.Error("Third login should be rate limited")
+	}
+	if got := e.RetryAfter(r); got != 60 {
+		t.Errorf("RetryAfter() = %d, want 60", got)
+	}
+	r.RemoteAddr = "192.0.2.2:1234"
+	if ok, _ := e.Allow(r); !ok {
+		t.Error("Login of other client should be allowed")
+	}
+
+	// method does not match
+	if ok, rule := e.Allow(httptest.NewRequest("GET", "/login", nil)); !ok || rule != nil {
+		t.Errorf("GET /login: Allow() = %v, %v, want true, nil", ok, rule)
+	}
+
+	for i := 0; i < 4; i++ {
+		r := httptest.NewRequest("GET", "/api/users", nil)
+		r.Header.Set("X-Tenant", "acme")
+		r.Header.Set("X-Api-Key", "k1")
+		ok, rule := e.Allow(r)
+		if rule == nil || rule.Name != "api" {
+			t.Fatalf("Request %d matched rule %v, want api", i, rule)
+		}
+		if want := i < 3; ok != want {
+			t.Errorf("Request %d: Allow() = %v, want %v", i, ok, want)
+		}
+	}
+
+	// header or key missing
+	r = httptest.NewRequest("GET", "/api/users", nil)
+	r.Header.Set("X-Api-Key", "k1")
+	if ok, rule := e.Allow(r); !ok || rule != nil {
+		t.Errorf("Request without X-Tenant: Allow() = %v, %v, want true, nil", ok, rule)
+	}
+	r = httptest.NewRequest("GET", "/api/users", nil)
+	r.Header.Set("X-Tenant", "acme")
+	if ok, rule := e.Allow(r); !ok || rule != nil {
+		t.Errorf("Request without key: Allow() = %v, %v, want true, nil", ok, rule)
+	}
+}
+
+func TestParseRulesJSON(t *testing.T) {
+	rc, err := ParseRules([]byte(`{"rules": [{"name": "all", "key": "global", "limit": 1, "window": "1h"}]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse JSON rules: %v", err)
+	}
+	if len(rc.Rules) != 1 || rc.Rules[0].Key != "global" || rc.Rules[0].Window != "1h" {
+		t.Fatalf("Unexpected rules: %+v", rc.Rules)
+	}
+
+	e, err := NewRuleEngine(rc)
+	if err != nil {
+		t.Fatalf("Failed to create rule engine: %v", err)
+	}
+	defer e.Close()
+	r := httptest.NewRequest("GET", "/", nil)
+	if ok, _ := e.Allow(r); !ok {
+		t.Error("First request should be allowed")
+	}
+	r.RemoteAddr = "192.0.2.2:1234"
+	if ok, _ := e.Allow(r); ok {
+		t.Error("Second request of any client should be rate limited")
+	}
+}
+
+func TestRuleEngineGlobalContextKey(t *testing.T) {
+	e, err := NewRuleEngine(&RuleConfig{Rules: []Rule{{Name: "all", Key: "global", Limit: 1, Window: "1h"}}})
+	if err != nil {
+		t.Fatalf("Failed to create rule engine: %v", err)
+	}
+	defer e.Close()
+	for i := 0; i < 5; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(ContextWithKey(r.Context(), fmt.Sprintf("client%d", i)))
+		if ok, _ := e.Allow(r); ok != (i == 0) {
+			t.Errorf("Request %d: Allow() = %v, want %v", i, ok, i == 0)
+		}
+	}
+}
+
+func TestRuleEngineBurst(t *testing.T) {
+	e, err := NewRuleEngine(&RuleConfig{Rules: []Rule{{Name: "all", Key: "global", Limit: 1, Window: "1h", Burst: 2}}})
+	if err != nil {
+		t.Fatalf("Failed to create rule engine: %v", err)
+	}
+	defer e.Close()
+	r := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 4; i++ {
+		if ok, _ := e.Allow(r); ok != (i < 3) {
+			t.Errorf("Request %d: Allow() = %v, want %v", i, ok, i < 3)
+		}
+	}
+	// the burst is refilled by one request per hour
+	if got := e.RetryAfter(r); got != 3600 {
+		t.Errorf("RetryAfter() = %d, want %d", got, 3600)
+	}
+}
+
+func TestParseRulesUnknownField(t *testing.T) {
+	if _, err := ParseRules([]byte("rules:\n- name: a\n  limt: 1\n")); err == nil {
+		t.Error("Expected error for unknown field")
+	}
+}
+
+func TestRuleEngineInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		rule Rule
+	}{
+		{"no name", Rule{Limit: 1, Window: "1s"}},
+		{"key", Rule{Name: "a", Key: "cookie", Limit: 1, Window: "1s"}},
+		{"algorithm", Rule{Name: "a", Algorithm: "TokenBucket", Limit: 1, Window: "1s"}},
+		{"window", Rule{Name: "a", Limit: 1, Window: "1 minute"}},
+		{"limit", Rule{Name: "a", Limit: 0, Window: "1s"}},
+		{"burst", Rule{Name: "a", Limit: 1, Window: "1s", Burst: -1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRuleEngine(&RuleConfig{Rules: []Rule{tt.rule}})
+			if !errors.Is(err, ErrInvalidArgument) {
+				t.Errorf("Expected ErrInvalidArgument, got %v", err)
+			}
+		})
+	}
+
+	rule := Rule{Name: "a", Limit: 1, Window: "1s"}
+	_, err := NewRuleEngine(&RuleConfig{Rules: []Rule{rule, rule}})
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected ErrInvalidArgument for duplicate name, got %v", err)
+	}
+}
+
+func TestRuleEngineReload(t *testing.T) {
+	e := newTestRuleEngine(t, testRules, WithClock(newFakeClock()))
+	login := httptest.NewRequest("POST", "/login", nil)
+	for i := 0; i < 2; i++ {
+		e.Allow(login)
+	}
+	before, _ := e.Limiter("login")
+
+	// changed match and new rule keep the state of login
+	rc, _ := ParseRules([]byte(testRules))
+	rc.Rules[0].Match.Route = "/signin"
+	rc.Rules[0].Window = "60s"
+	rc.Rules = append(rc.Rules, Rule{Name: "other", Limit: 1, Window: "1s"})
+	if err := e.Reload(rc); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if l, _ := e.Limiter("login"); l != before {
+		t.Error("Limiter of unchanged limit should be kept")
+	}
+	if ok, _ := e.Allow(httptest.NewRequest("POST", "/signin", nil)); ok {
+		t.Error("State of login should be kept")
+	}
+
+	// invalid rules keep the current rules
+	rc.Rules[0].Limit = -1
+	if err := e.Reload(rc); err == nil {
+		t.Fatal("Expected error for invalid rule")
+	}
+	if l, _ := e.Limiter("login"); l != before {
+		t.Error("Invalid reload should keep current rules")
+	}
+
+	// changed limit resets the state
+	rc.Rules[0].Limit = 3
+	if err := e.Reload(rc); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if ok, _ := e.Allow(httptest.NewRequest("POST", "/signin", nil)); !ok {
+		t.Error("Changed limit should reset the state")
+	}
+	if _, ok := e.Limiter("api"); !ok {
+		t.Error("Rule api should exist")
+	}
+}
+
+func TestRuleEngineReloadConcurrent(t *testing.T) {
+	e := newTestRuleEngine(t, testRules)
+	rc, _ := ParseRules([]byte(testRules))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				e.Allow(httptest.NewRequest("POST", "/login", nil))
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		rc.Rules[1].Limit = i + 1
+		if err := e.Reload(rc); err != nil {
+			t.Fatalf("Failed to reload: %v", err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestRuleEngineWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(testRules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %v", err)
+	}
+	e, err := NewRuleEngine(rc)
+	if err != nil {
+		t.Fatalf("Failed to create rule engine: %v", err)
+	}
+	defer e.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCH := make(chan error, 10)
+	go e.Watch(ctx, path, time.Millisecond, func(err error) { errCH <- err })
+
+	update := func(data string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update("rules: [{name: all, limit: 1, window: 1h}]", time.Now().Add(time.Minute))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := e.Limiter("all"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Rules were not reloaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	update("rules: [{name: all, limit: 0, window: 1h}]", time.Now().Add(2*time.Minute))
+	select {
+	case err := <-errCH:
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("Expected ErrInvalidArgument, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected error for invalid rules")
+	}
+	if _, ok := e.Limiter("all"); !ok {
+		t.Error("Invalid rules should not replace current rules")
+	}
+}
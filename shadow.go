@@ -0,0 +1,183 @@
+package circularbuffer
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShadowLimiter evaluates every request against a shadow
+// ClientRateLimiter without enforcing its decision. It records the
+// requests the shadow limiter would have rejected, such that new
+// limits can be compared to the enforced limits in production, before
+// they are rolled out.
+//
+// ShadowLimiter implements the RateLimiter interface and delegates
+// all methods, but Allow and Close, to the enforced RateLimiter.
+type ShadowLimiter struct {
+	enforced RateLimiter
+	shadow   *ClientRateLimiter
+
+	requests         atomic.Uint64
+	shadowRejected   atomic.Uint64
+	enforcedRejected atomic.Uint64
+	bothRejected     atomic.Uint64
+
+	mu            sync.Mutex
+	maxSampleKeys int
+	keys          map[string]uint64
+	droppedKeys   uint64
+}
+
+// ShadowStats are the decisions recorded by a ShadowLimiter.
+type ShadowStats struct {
+	// Requests is the number of calls to Allow.
+	Requests uint64
+	// ShadowRejected is the number of requests the shadow limiter
+	// would have rejected.
+	ShadowRejected uint64
+	// EnforcedRejected is the number of requests rejected by the
+	// enforced limiter.
+	EnforcedRejected uint64
+	// BothRejected is the number of requests rejected by both.
+	BothRejected uint64
+	// Keys are the would-be rejections per key for a bounded
+	// sample of keys.
+	Keys map[string]uint64
+	// DroppedKeys is the number of would-be rejections of keys,
+	// that did not fit into the sample.
+	DroppedKeys uint64
+}
+
+// NewShadowLimiter returns a ShadowLimiter, which enforces the
+// decisions of enforced and records the decisions of shadow. If
+// enforced is nil, Allow always returns true. Would-be rejections are
+// counted per key for up to maxSampleKeys distinct keys.
+func NewShadowLimiter(enforced RateLimiter, shadow *ClientRateLimiter, maxSampleKeys int) *ShadowLimiter {
+	return &ShadowLimiter{
+		enforced:      enforced,
+		shadow:        shadow,
+		maxSampleKeys: maxSampleKeys,
+		keys:          make(map[string]uint64),
+	}
+}
+
+// Allow evaluates the request s against the shadow limiter and
+// returns the decision of the enforced limiter.
+func (sl *ShadowLimiter) Allow(ctx context.Context, s string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	s = keyOf(ctx, s)
+	sl.requests.Add(1)
+	shadowAllowed := sl.shadow.Allow(ctx, s)
+	allowed := true
+	if sl.enforced != nil {
+		allowed = sl.enforced.Allow(ctx, s)
+	}
+
+	if !allowed {
+		sl.enforcedRejected.Add(1)
+	}
+	if !shadowAllowed {
+		sl.shadowRejected.Add(1)
+		if !allowed {
+			sl.bothRejected.Add(1)
+		}
+		sl.record(s)
+	}
+	recordDecision(ctx, sl, s, allowed)
+	return allowed
+}
+
+func (sl *ShadowLimiter) record(s string) {
+	sl.mu.Lock()
+	if _, ok := sl.keys[s]; ok || len(sl.keys) < sl.maxSampleKeys {
+		sl.keys[s]++
+	} else {
+		sl.droppedKeys++
+	}
+	sl.mu.Unlock()
+}
+
+// Stats returns a snapshot of the recorded decisions.
+func (sl *ShadowLimiter) Stats() ShadowStats {
+	st := ShadowStats{
+		Requests:         sl.requests.Load(),
+		ShadowRejected:   sl.shadowRejected.Load(),
+		EnforcedRejected: sl.enforcedRejected.Load(),
+		BothRejected:     sl.bothRejected.Load(),
+	}
+	sl.mu.Lock()
+	st.Keys = make(map[string]uint64, len(sl.keys))
+	for k, v := range sl.keys {
+		st.Keys[k] = v
+	}
+	st.DroppedKeys = sl.droppedKeys
+	sl.mu.Unlock()
+	return st
+}
+
+// Shadow returns the shadow limiter, for example to inspect the
+// state of a key.
+func (sl *ShadowLimiter) Shadow() *ClientRateLimiter {
+	return sl.shadow
+}
+
+// Close closes the enforced and the shadow limiter.
+func (sl *ShadowLimiter) Close() {
+	if sl.enforced != nil {
+		sl.enforced.Close()
+	}
+	sl.shadow.Close()
+}
+
+// Oldest implements the RateLimiter interface
+func (sl *ShadowLimiter) Oldest(s string) time.Time {
+	if sl.enforced == nil {
+		return time.Time{}
+	}
+	return sl.enforced.Oldest(s)
+}
+
+// Delta implements the RateLimiter interface
+func (sl *ShadowLimiter) Delta(s string) time.Duration {
+	if sl.enforced == nil {
+		return time.Duration(time.Hour * 24)
+	}
+	return sl.enforced.Delta(s)
+}
+
+// Resize implements the RateLimiter interface
+func (sl *ShadowLimiter) Resize(s string, n int) error {
+	if sl.enforced == nil {
+		return keyNotFound(s)
+	}
+	return sl.enforced.Resize(s, n)
+}
+
+// Remaining implements the RateLimiter interface
+func (sl *ShadowLimiter) Remaining(s string) int {
+	if sl.enforced == nil {
+		return math.MaxInt
+	}
+	return sl.enforced.Remaining(s)
+}
+
+// Reset resets the key s of the enforced and the shadow limiter.
+func (sl *ShadowLimiter) Reset(s string) {
+	if sl.enforced != nil {
+		sl.enforced.Reset(s)
+	}
+	sl.shadow.Reset(s)
+}
+
+// RetryAfter implements the RateLimiter interface
+func (sl *ShadowLimiter) RetryAfter(s string) int {
+	if sl.enforced == nil {
+		return 0
+	}
+	return sl.enforced.RetryAfter(s)
+}
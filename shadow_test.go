@@ -0,0 +1,67 @@
+package circularbuffer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestShadowLimiter(t *testing.T) {
+	clock := newFakeClock()
+	enforced, err := NewClientRateLimiterWithOptions(3, time.Minute, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	shadow, err := NewClientRateLimiterWithOptions(1, time.Minute, WithClock(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sl := NewShadowLimiter(enforced, shadow, 2)
+	defer sl.Close()
+
+	for i := 0; i < 4; i++ {
+		allowed := sl.Allow(t.Context(), "foo")
+		if want := i < 3; allowed != want {
+			t.Errorf("request %d: expected enforced decision %v, got %v", i, want, allowed)
+		}
+	}
+	sl.Allow(t.Context(), "bar")
+	sl.Allow(t.Context(), "bar")
+	sl.Allow(t.Context(), "baz")
+	sl.Allow(t.Context(), "baz")
+
+	st := sl.Stats()
+	if st.Requests != 8 {
+		t.Errorf("expected 8 requests, got %d", st.Requests)
+	}
+	if st.ShadowRejected != 5 {
+		t.Errorf("expected 5 shadow rejections, got %d", st.ShadowRejected)
+	}
+	if st.EnforcedRejected != 1 || st.BothRejected != 1 {
+		t.Errorf("expected 1 enforced and both rejection, got %d and %d", st.EnforcedRejected, st.BothRejected)
+	}
+	if fmt.Sprint(st.Keys) != "map[bar:1 foo:3]" {
+		t.Errorf("unexpected sampled keys: %v", st.Keys)
+	}
+	if st.DroppedKeys != 1 {
+		t.Errorf("expected 1 dropped key rejection, got %d", st.DroppedKeys)
+	}
+	if sl.Remaining("foo") != 0 || sl.Shadow().Remaining("bar") != 0 {
+		t.Errorf("unexpected remaining %d and %d", sl.Remaining("foo"), sl.Shadow().Remaining("bar"))
+	}
+}
+
+func TestShadowLimiterWithoutEnforced(t *testing.T) {
+	shadow := newClientRateLimiter(1, time.Minute)
+	sl := NewShadowLimiter(nil, shadow, 10)
+	defer sl.Close()
+
+	for i := 0; i < 3; i++ {
+		if !sl.Allow(t.Context(), "foo") {
+			t.Errorf("shadow limiter should never rate limit")
+		}
+	}
+	if st := sl.Stats(); st.ShadowRejected != 2 || st.Keys["foo"] != 2 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
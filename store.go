@@ -0,0 +1,173 @@
+package circularbuffer
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// Store stores the CircularBuffer of each key of a KeyedLimiter. The
+// default Store is a MapStore, ShardedStore reduces lock contention
+// with many concurrent keys, and other implementations can be set by
+// WithStore. Implementations must be safe for concurrent use. The
+// functions passed to a Store must not call back into the Store.
+type Store[K comparable] interface {
+	// Get returns the buffer of k and true, if k is stored.
+	Get(k K) (*CircularBuffer, bool)
+	// GetOrCreate returns the buffer of k. If k is not stored, it
+	// stores and returns the result of create and true. If create
+	// returns nil, nothing is stored.
+	GetOrCreate(k K, create func() *CircularBuffer) (*CircularBuffer, bool)
+	// Delete removes k and returns true, if k was stored.
+	Delete(k K) bool
+	// Update calls f with the buffer of k, or nil, atomically with
+	// respect to the other methods for k. The buffer returned by f
+	// is stored, if it is nil, k is removed.
+	Update(k K, f func(*CircularBuffer) *CircularBuffer)
+	// Range calls f for every key until f returns false.
+	Range(f func(K, *CircularBuffer) bool)
+	// Len returns the number of stored keys.
+	Len() int
+}
+
+// MapStore is a Store of a map guarded by a sync.RWMutex.
+type MapStore[K comparable] struct {
+	mu sync.RWMutex
+	m  map[K]*CircularBuffer
+}
+
+// NewMapStore returns an empty MapStore.
+func NewMapStore[K comparable]() *MapStore[K] {
+	return &MapStore[K]{m: make(map[K]*CircularBuffer)}
+}
+
+func (s *MapStore[K]) Get(k K) (*CircularBuffer, bool) {
+	s.mu.RLock()
+	cb, ok := s.m[k]
+	s.mu.RUnlock()
+	return cb, ok
+}
+
+func (s *MapStore[K]) GetOrCreate(k K, create func() *CircularBuffer) (*CircularBuffer, bool) {
+	if cb, ok := s.Get(k); ok {
+		return cb, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cb, ok := s.m[k]; ok {
+		return cb, false
+	}
+	cb := create()
+	if cb == nil {
+		return nil, false
+	}
+	s.m[k] = cb
+	return cb, true
+}
+
+func (s *MapStore[K]) Delete(k K) bool {
+	s.mu.Lock()
+	_, ok := s.m[k]
+	delete(s.m, k)
+	s.mu.Unlock()
+	return ok
+}
+
+func (s *MapStore[K]) Update(k K, f func(*CircularBuffer) *CircularBuffer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cb := f(s.m[k]); cb != nil {
+		s.m[k] = cb
+	} else {
+		delete(s.m, k)
+	}
+}
+
+// Range works on a snapshot of the keys, such that f is called without
+// holding the lock.
+func (s *MapStore[K]) Range(f func(K, *CircularBuffer) bool) {
+	s.mu.RLock()
+	keys := make([]K, 0, len(s.m))
+	buffers := make([]*CircularBuffer, 0, len(s.m))
+	for k, cb := range s.m {
+		keys = append(keys, k)
+		buffers = append(buffers, cb)
+	}
+	s.mu.RUnlock()
+	for i, k := range keys {
+		if !f(k, buffers[i]) {
+			return
+		}
+	}
+}
+
+func (s *MapStore[K]) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.m)
+}
+
+// ShardedStore is a Store of MapStores selected by the hash of the
+// key, such that requests of different keys rarely wait for the same
+// lock.
+type ShardedStore[K comparable] struct {
+	seed   maphash.Seed
+	shards []*MapStore[K]
+}
+
+// NewShardedStore returns an empty ShardedStore with n shards. It
+// returns an *ArgumentError if n <= 0.
+func NewShardedStore[K comparable](n int) (*ShardedStore[K], error) {
+	if n <= 0 {
+		return nil, &ArgumentError{Name: "shards", Value: n}
+	}
+	s := &ShardedStore[K]{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*MapStore[K], n),
+	}
+	for i := range s.shards {
+		s.shards[i] = NewMapStore[K]()
+	}
+	return s, nil
+}
+
+func (s *ShardedStore[K]) shard(k K) *MapStore[K] {
+	return s.shards[maphash.Comparable(s.seed, k)%uint64(len(s.shards))]
+}
+
+func (s *ShardedStore[K]) Get(k K) (*CircularBuffer, bool) {
+	return s.shard(k).Get(k)
+}
+
+func (s *ShardedStore[K]) GetOrCreate(k K, create func() *CircularBuffer) (*CircularBuffer, bool) {
+	return s.shard(k).GetOrCreate(k, create)
+}
+
+func (s *ShardedStore[K]) Delete(k K) bool {
+	return s.shard(k).Delete(k)
+}
+
+func (s *ShardedStore[K]) Update(k K, f func(*CircularBuffer) *CircularBuffer) {
+	s.shard(k).Update(k, f)
+}
+
+// Range calls f for the keys of one shard after the other.
+func (s *ShardedStore[K]) Range(f func(K, *CircularBuffer) bool) {
+	for _, shard := range s.shards {
+		cont := true
+		shard.Range(func(k K, cb *CircularBuffer) bool {
+			cont = f(k, cb)
+			return cont
+		})
+		if !cont {
+			return
+		}
+	}
+}
+
+func (s *ShardedStore[K]) Len() int {
+	var n int
+	for _, shard := range s.shards {
+		n += shard.Len()
+	}
+	return n
+}
@@ -0,0 +1,198 @@
+package circularbuffer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newStores(t testing.TB) map[string]Store[string] {
+	sharded, err := NewShardedStore[string](4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return map[string]Store[string]{
+		"map":     NewMapStore[string](),
+		"sharded": sharded,
+	}
+}
+
+func TestStore(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			newBuffer := func() *CircularBuffer { return NewCircularBuffer(1, time.Second) }
+
+			foo, created := store.GetOrCreate("foo", newBuffer)
+			if foo == nil || !created {
+				t.Fatalf("expected foo to be created")
+			}
+			if cb, created := store.GetOrCreate("foo", newBuffer); cb != foo || created {
+				t.Errorf("expected stored foo")
+			}
+			if cb, created := store.GetOrCreate("bar", func() *CircularBuffer { return nil }); cb != nil || created {
+				t.Errorf("expected bar not to be created")
+			}
+			if _, ok := store.Get("bar"); ok {
+				t.Errorf("bar should not be stored")
+			}
+			for _, k := range []string{"bar", "baz", "qux"} {
+				store.Update(k, func(cb *CircularBuffer) *CircularBuffer {
+					if cb != nil {
+						t.Errorf("%s: expected nil buffer", k)
+					}
+					return newBuffer()
+				})
+			}
+			if n := store.Len(); n != 4 {
+				t.Errorf("expected 4 keys, got %d", n)
+			}
+
+			var n int
+			store.Range(func(string, *CircularBuffer) bool {
+				n++
+				return n < 2
+			})
+			if n != 2 {
+				t.Errorf("expected Range to stop after 2 keys, got %d", n)
+			}
+
+			store.Update("bar", func(*CircularBuffer) *CircularBuffer { return nil })
+			if _, ok := store.Get("bar"); ok {
+				t.Errorf("bar should be removed by Update")
+			}
+			if !store.Delete("foo") || store.Delete("foo") {
+				t.Errorf("expected foo to be deleted once")
+			}
+			if n := store.Len(); n != 2 {
+				t.Errorf("expected 2 keys, got %d", n)
+			}
+		})
+	}
+
+	if _, err := NewShardedStore[string](0); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+func TestWithStore(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			clock := newFakeClock()
+			var evicted atomic.Int64
+			rl, err := NewClientRateLimiterWithOptions(2, time.Second, WithClock(clock), WithStore(store), WithMaxKeys(50),
+				WithHooks(Hooks{OnEvict: func(string) { evicted.Add(1) }}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rl.Close()
+
+			var wg sync.WaitGroup
+			var allowed atomic.Int64
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						if rl.Allow(t.Context(), fmt.Sprintf("foo%d", j)) {
+							allowed.Add(1)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			if n := store.Len(); n != 50 {
+				t.Errorf("expected 50 keys, got %d", n)
+			}
+			if n := allowed.Load(); n != 100 {
+				t.Errorf("expected 100 allowed requests of 50 keys, got %d", n)
+			}
+
+			clock.Advance(time.Second + time.Nanosecond)
+			rl.DeleteOld()
+			if n := store.Len(); n != 0 {
+				t.Errorf("expected all keys to be deleted, got %d", n)
+			}
+			if n := evicted.Load(); n != 50 {
+				t.Errorf("expected 50 evicted keys, got %d", n)
+			}
+			if !rl.Allow(t.Context(), "bar") {
+				t.Errorf("new key should not be rate limitted after the keys were deleted")
+			}
+		})
+	}
+
+	_, err := NewClientRateLimiterWithOptions(2, time.Second, WithStore[int](NewMapStore[int]()))
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument for a store of another key type, got %v", err)
+	}
+}
+
+func TestWithStorePreloaded(t *testing.T) {
+	for name, store := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			clock := newFakeClock()
+			for _, k := range []string{"foo", "bar"} {
+				cb, err := NewCircularBufferWithOptions(2, time.Second, WithClock(clock))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				cb.Add(clock.Now())
+				store.GetOrCreate(k, func() *CircularBuffer { return cb })
+			}
+			var evicted atomic.Int64
+			rl, err := NewClientRateLimiterWithOptions(2, time.Second, WithClock(clock), WithStore(store),
+				WithHooks(Hooks{OnEvict: func(string) { evicted.Add(1) }}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rl.Close()
+
+			clock.Advance(500 * time.Millisecond)
+			rl.Allow(t.Context(), "foo")
+			clock.Advance(600 * time.Millisecond)
+			rl.expire()
+			if _, ok := store.Get("bar"); ok {
+				t.Errorf("preloaded key should expire after the time window")
+			}
+			if _, ok := store.Get("foo"); !ok {
+				t.Errorf("preloaded key in use should not expire")
+			}
+
+			clock.Advance(time.Second)
+			rl.expire()
+			if n := store.Len(); n != 0 {
+				t.Errorf("expected all keys to expire, got %d", n)
+			}
+			if n := evicted.Load(); n != 2 {
+				t.Errorf("expected 2 evicted keys, got %d", n)
+			}
+		})
+	}
+}
+
+func BenchmarkStoreAllowParallel(b *testing.B) {
+	for name, store := range newStores(b) {
+		b.Run(name, func(b *testing.B) {
+			rl, err := NewClientRateLimiterWithOptions(100, time.Second, WithStore(store))
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+			defer rl.Close()
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("foo%d", i)
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					rl.Allow(context.Background(), keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package circularbuffer
+
+import "time"
+
+// wheelSlots is the number of slots of a timingWheel per time window.
+const wheelSlots = 64
+
+// timingWheel schedules the expiry of the keys of a KeyedLimiter. A
+// key is put into the slot of its deadline, such that expiring keys
+// only looks at the keys of the slots passed, instead of scanning all
+// keys. The wheel spans one time window plus one slot, deadlines
+// further in the future are rescheduled when their slot is passed.
+// timingWheel is not safe for concurrent use.
+type timingWheel[K comparable] struct {
+	tick  time.Duration
+	slots [][]expiry[K]
+	// next is the start of the next slot to expire
+	next time.Time
+}
+
+type expiry[K comparable] struct {
+	key      K
+	cb       *CircularBuffer
+	deadline time.Time
+}
+
+func newTimingWheel[K comparable](window time.Duration, now time.Time) *timingWheel[K] {
+	w := &timingWheel[K]{
+		tick:  max(window/wheelSlots, time.Nanosecond),
+		slots: make([][]expiry[K], wheelSlots+2),
+	}
+	w.next = w.floor(now)
+	return w
+}
+
+// floor returns the start of the slot of time t.
+func (w *timingWheel[K]) floor(t time.Time) time.Time {
+	n := t.UnixNano()
+	return time.Unix(0, n-((n%int64(w.tick))+int64(w.tick))%int64(w.tick))
+}
+
+// index returns the slot of time t.
+func (w *timingWheel[K]) index(t time.Time) int {
+	n := int64(len(w.slots))
+	return int((t.UnixNano()/int64(w.tick)%n + n) % n)
+}
+
+// schedule adds e to the slot of its deadline. Deadlines in the past
+// are scheduled into the next slot.
+func (w *timingWheel[K]) schedule(e expiry[K]) {
+	if e.deadline.Before(w.next) {
+		e.deadline = w.next
+	}
+	i := w.index(e.deadline)
+	w.slots[i] = append(w.slots[i], e)
+}
+
+// due removes and returns the entries of the next slot with a
+// deadline before its end, if the slot is passed at now. It returns
+// false if no slot is passed.
+func (w *timingWheel[K]) due(now time.Time) ([]expiry[K], bool) {
+	span := w.tick * time.Duration(len(w.slots))
+	if now.Sub(w.next) > 2*span {
+		// skip revolutions without any work after a clock jump or
+		// a long pause, one revolution visits all entries
+		w.next = w.floor(now).Add(-span)
+	}
+	end := w.next.Add(w.tick)
+	if now.Before(end) {
+		return nil, false
+	}
+
+	i := w.index(w.next)
+	entries := w.slots[i]
+	w.slots[i] = nil
+	w.next = end
+
+	due := entries[:0]
+	for _, e := range entries {
+		if e.deadline.Before(end) {
+			due = append(due, e)
+		} else {
+			w.schedule(e)
+		}
+	}
+	return due, true
+}
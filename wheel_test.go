@@ -0,0 +1,112 @@
+package circularbuffer
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTimingWheelDue(t *testing.T) {
+	start := newFakeClock().Now()
+	w := newTimingWheel[string](64*time.Second, start)
+	for i, d := range []time.Duration{10 * time.Second, 0, 5 * time.Minute, 63 * time.Second} {
+		w.schedule(expiry[string]{key: strconv.Itoa(i), deadline: start.Add(d)})
+	}
+
+	due := func(now time.Time) []string {
+		var keys []string
+		for {
+			entries, ok := w.due(now)
+			if !ok {
+				return keys
+			}
+			for _, e := range entries {
+				keys = append(keys, e.key)
+			}
+		}
+	}
+
+	if keys := due(start.Add(time.Second)); len(keys) != 1 || keys[0] != "1" {
+		t.Errorf("expected key 1 to be due, got %v", keys)
+	}
+	if keys := due(start.Add(10 * time.Second)); len(keys) != 0 {
+		t.Errorf("expected no key to be due, got %v", keys)
+	}
+	if keys := due(start.Add(11 * time.Second)); len(keys) != 1 || keys[0] != "0" {
+		t.Errorf("expected key 0 to be due, got %v", keys)
+	}
+	if keys := due(start.Add(2 * time.Minute)); len(keys) != 1 || keys[0] != "3" {
+		t.Errorf("expected key 3 to be due, got %v", keys)
+	}
+	// clock jump beyond the span of the wheel
+	if keys := due(start.Add(24 * time.Hour)); len(keys) != 1 || keys[0] != "2" {
+		t.Errorf("expected key 2 to be due, got %v", keys)
+	}
+}
+
+func TestKeyedLimiterExpire(t *testing.T) {
+	clock := newFakeClock()
+	window := time.Minute
+	var evicted []string
+	rl, err := NewClientRateLimiterWithOptions(2, window, WithClock(clock), WithHooks(Hooks{
+		OnEvict: func(key string) { evicted = append(evicted, key) },
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	rl.Allow(t.Context(), "foo")
+	rl.Allow(t.Context(), "bar")
+	clock.Advance(window / 2)
+	rl.Allow(t.Context(), "bar")
+
+	clock.Advance(window/2 + time.Second)
+	rl.expire()
+	if _, ok := rl.store.Get("foo"); ok {
+		t.Errorf("foo should be expired")
+	}
+	if _, ok := rl.store.Get("bar"); !ok {
+		t.Errorf("bar should be rescheduled")
+	}
+
+	clock.Advance(window / 2)
+	rl.expire()
+	if rl.store.Len() != 0 {
+		t.Errorf("expected all keys to expire, got %d", rl.store.Len())
+	}
+	if len(evicted) != 2 || evicted[0] != "foo" || evicted[1] != "bar" {
+		t.Errorf("expected OnEvict for foo and bar, got %v", evicted)
+	}
+
+	// removed and recreated keys are scheduled again
+	rl.Allow(t.Context(), "foo")
+	rl.Remove("foo")
+	rl.Allow(t.Context(), "foo")
+	clock.Advance(window + time.Second)
+	rl.expire()
+	if rl.store.Len() != 0 {
+		t.Errorf("expected foo to expire, got %d keys", rl.store.Len())
+	}
+}
+
+func benchmarkCleanup(b *testing.B, cleanup func(*ClientRateLimiter)) {
+	clock := newFakeClock()
+	rl, _ := NewClientRateLimiterWithOptions(10, time.Minute, WithClock(clock))
+	defer rl.Close()
+	for i := 0; i < 100000; i++ {
+		rl.Allow(b.Context(), strconv.Itoa(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cleanup(rl)
+	}
+}
+
+func BenchmarkDeleteOld(b *testing.B) {
+	benchmarkCleanup(b, (*ClientRateLimiter).DeleteOld)
+}
+
+func BenchmarkExpire(b *testing.B) {
+	benchmarkCleanup(b, (*ClientRateLimiter).expire)
+}